@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"emqx-exporter/config"
+
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshot is the metrics of a collector refreshed in the background.
+type snapshot struct {
+	interval     time.Duration
+	maxStaleness time.Duration
+
+	mtx sync.RWMutex
+	// refreshed is whether the collector has been refreshed at least once.
+	refreshed bool
+	// result is the result of the last refresh, and metrics are the metrics of the last successful one.
+	result      result
+	metrics     []prometheus.Metric
+	lastSuccess time.Time
+}
+
+// startCache refreshes the collectors at their intervals in the background until ctx is done, from the time the
+// version of EMQX is detected by the client, and n serves their snapshots from then on. It must be called before
+// n is collected.
+func (n *EMQXCollector) startCache(ctx context.Context, client *client, cache *config.CacheConfig) {
+	n.snapshots = make(map[string]*snapshot, len(n.Collectors))
+	for name, c := range n.Collectors {
+		s := &snapshot{interval: cache.IntervalOf(name), maxStaleness: cache.MaxStalenessOf(name)}
+		n.snapshots[name] = s
+		go func(name string, c Collector) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.detected:
+			}
+			s.run(ctx, name, c, n.logger)
+		}(name, c)
+	}
+}
+
+func (s *snapshot) run(ctx context.Context, name string, c Collector, logger log.Logger) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.refresh(ctx, name, c, logger)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh updates the collector within the interval, the metrics are replaced only if it succeeds.
+func (s *snapshot) refresh(ctx context.Context, name string, c Collector, logger log.Logger) {
+	ctx, cancel := context.WithTimeout(ctx, s.interval)
+	defer cancel()
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		var metrics []prometheus.Metric
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		done <- metrics
+	}()
+	r := execute(ctx, name, c, ch, logger)
+	close(ch)
+	metrics := <-done
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.refreshed = true
+	s.result = r
+	if r.success {
+		s.metrics = metrics
+		s.lastSuccess = time.Now()
+	}
+}
+
+// collect sends the metrics of the last successful refresh unless they're older than the max staleness, with the
+// result of the last refresh and the time of the last success. Nothing is sent before the first refresh.
+func (s *snapshot) collect(name string, ch chan<- prometheus.Metric) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if !s.refreshed {
+		return
+	}
+	if !s.lastSuccess.IsZero() {
+		if time.Since(s.lastSuccess) <= s.maxStaleness {
+			for _, m := range s.metrics {
+				ch <- m
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeLastSuccessDesc, prometheus.GaugeValue,
+			float64(s.lastSuccess.UnixNano())/1e9, name)
+	}
+	s.result.send(name, ch)
+}
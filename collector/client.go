@@ -3,6 +3,7 @@ package collector
 import (
 	"context"
 	"emqx-exporter/config"
+	"emqx-exporter/tlsinfo"
 	"sync"
 	"time"
 
@@ -24,31 +25,45 @@ const (
 )
 
 type emqxClientInterface interface {
-	getLicense() (*LicenseInfo, error)
-	getClusterStatus() (ClusterStatus, error)
-	getBrokerMetrics() (*Broker, error)
-	getDataBridge() ([]DataBridge, error)
-	getRuleEngineMetrics() ([]RuleEngine, error)
-	getAuthenticationMetrics() ([]DataSource, []Authentication, error)
-	getAuthorizationMetrics() ([]DataSource, []Authorization, error)
+	getLicense(ctx context.Context) (*LicenseInfo, error)
+	getClusterStatus(ctx context.Context) (ClusterStatus, error)
+	getBrokerMetrics(ctx context.Context) (*Broker, error)
+	getDataBridge(ctx context.Context) ([]DataBridge, error)
+	getRuleEngineMetrics(ctx context.Context) ([]RuleEngine, error)
+	getAuthenticationMetrics(ctx context.Context) ([]DataSource, []Authentication, error)
+	getAuthorizationMetrics(ctx context.Context) ([]DataSource, []Authorization, error)
 }
 
+// client holds the client of the detected version of EMQX. The lock guards the swap of emqxClient only,
+// the collectors fetch from EMQX concurrently, limited by the requester.
 type client struct {
 	sync.RWMutex
 	emqxClient emqxClientInterface
+	// detected is closed once the version of EMQX is detected.
+	detected chan struct{}
+	// tls records the TLS handshakes with the API of EMQX.
+	tls *tlsinfo.State
 }
 
-func newClient(metrics *config.Metrics, logger log.Logger) *client {
-	c := &client{emqxClient: nil}
+// newClient creates a client and detects the version of EMQX in the background until ctx is done.
+// The requests to the API are observed by apiMetrics unless it's nil.
+func newClient(ctx context.Context, metrics *config.Metrics, apiMetrics *apiMetrics, logger log.Logger) *client {
+	c := &client{emqxClient: nil, detected: make(chan struct{}), tls: tlsinfo.NewState()}
 
 	go func() {
-		requester := newRequester(metrics)
+		requester := newRequester(metrics, c.tls, apiMetrics)
 		for {
+			if ctx.Err() != nil {
+				return
+			}
 			client4 := &client4x{
 				requester: requester,
 			}
-			if _, err := client4.getClusterStatus(); err == nil {
+			if _, err := client4.getClusterStatus(ctx); err == nil {
+				c.Lock()
 				c.emqxClient = client4
+				c.Unlock()
+				close(c.detected)
 				level.Info(logger).Log("msg", "client4x client created")
 				return
 			} else {
@@ -58,8 +73,11 @@ func newClient(metrics *config.Metrics, logger log.Logger) *client {
 			client5 := &client5x{
 				requester: requester,
 			}
-			if _, err := client5.getClusterStatus(); err == nil {
+			if _, err := client5.getClusterStatus(ctx); err == nil {
+				c.Lock()
 				c.emqxClient = client5
+				c.Unlock()
+				close(c.detected)
 				level.Info(logger).Log("msg", "client5x client created")
 				return
 			} else {
@@ -68,10 +86,18 @@ func newClient(metrics *config.Metrics, logger log.Logger) *client {
 
 			level.Error(logger).Log("msg", "Couldn't create scraper client, will retry it after 5 seconds", "err", "no scraper node found")
 			select {
-			case <-context.Background().Done():
+			case <-ctx.Done():
+				return
 			case <-time.After(5 * time.Second):
 			}
 		}
 	}()
 	return c
 }
+
+// current returns the client of the detected version of EMQX, it's nil until the version is detected.
+func (c *client) current() emqxClientInterface {
+	c.RLock()
+	defer c.RUnlock()
+	return c.emqxClient
+}
@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -13,7 +14,7 @@ type client4x struct {
 	requester *requester
 }
 
-func (n *client4x) getLicense() (lic *LicenseInfo, err error) {
+func (n *client4x) getLicense(ctx context.Context) (lic *LicenseInfo, err error) {
 	resp := struct {
 		Data struct {
 			MaxConnections int64  `json:"max_connections"`
@@ -21,7 +22,7 @@ func (n *client4x) getLicense() (lic *LicenseInfo, err error) {
 		}
 		Code int
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v4/license", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v4/license"), &resp)
 	if err != nil {
 		return
 	}
@@ -39,7 +40,7 @@ func (n *client4x) getLicense() (lic *LicenseInfo, err error) {
 	return
 }
 
-func (n *client4x) getClusterStatus() (cluster ClusterStatus, err error) {
+func (n *client4x) getClusterStatus(ctx context.Context) (cluster ClusterStatus, err error) {
 	resp := struct {
 		Data []struct {
 			Version     string
@@ -54,7 +55,7 @@ func (n *client4x) getClusterStatus() (cluster ClusterStatus, err error) {
 		}
 		Code int
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v4/nodes", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v4/nodes"), &resp)
 	if err != nil {
 		return
 	}
@@ -85,7 +86,7 @@ func (n *client4x) getClusterStatus() (cluster ClusterStatus, err error) {
 	return
 }
 
-func (n *client4x) getBrokerMetrics() (metrics *Broker, err error) {
+func (n *client4x) getBrokerMetrics(ctx context.Context) (metrics *Broker, err error) {
 	resp := struct {
 		Data struct {
 			Sent     int64 `json:"sent"`
@@ -93,7 +94,7 @@ func (n *client4x) getBrokerMetrics() (metrics *Broker, err error) {
 		}
 		Code int
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v4/monitor/current_metrics", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v4/monitor/current_metrics"), &resp)
 	if err != nil {
 		return
 	}
@@ -105,7 +106,7 @@ func (n *client4x) getBrokerMetrics() (metrics *Broker, err error) {
 	return
 }
 
-func (n *client4x) getRuleEngineMetrics() (metrics []RuleEngine, err error) {
+func (n *client4x) getRuleEngineMetrics(ctx context.Context) (metrics []RuleEngine, err error) {
 	resp := struct {
 		Data []struct {
 			Metrics []struct {
@@ -132,7 +133,7 @@ func (n *client4x) getRuleEngineMetrics() (metrics []RuleEngine, err error) {
 		}
 		Code int
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v4/rules", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v4/rules"), &resp)
 	if err != nil {
 		return
 	}
@@ -181,7 +182,7 @@ func (n *client4x) getRuleEngineMetrics() (metrics []RuleEngine, err error) {
 	return
 }
 
-func (n *client4x) getDataBridge() (bridges []DataBridge, err error) {
+func (n *client4x) getDataBridge(ctx context.Context) (bridges []DataBridge, err error) {
 	resp := struct {
 		Data []struct {
 			ID     string `json:"id"`
@@ -190,7 +191,7 @@ func (n *client4x) getDataBridge() (bridges []DataBridge, err error) {
 		}
 		Code int
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v4/resources", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v4/resources"), &resp)
 	if err != nil {
 		return
 	}
@@ -208,11 +209,11 @@ func (n *client4x) getDataBridge() (bridges []DataBridge, err error) {
 	return
 }
 
-func (n *client4x) getAuthenticationMetrics() ([]DataSource, []Authentication, error) {
+func (n *client4x) getAuthenticationMetrics(ctx context.Context) ([]DataSource, []Authentication, error) {
 	return nil, nil, nil
 }
 
-func (n *client4x) getAuthorizationMetrics() ([]DataSource, []Authorization, error) {
+func (n *client4x) getAuthorizationMetrics(ctx context.Context) ([]DataSource, []Authorization, error) {
 	return nil, nil, nil
 }
 
@@ -1,20 +1,23 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 var _ emqxClientInterface = &client5x{}
 
 type client5x struct {
-	edition   edition
+	// edition is detected by getClusterStatus, which runs concurrently with getLicense.
+	edition   atomic.Int32
 	requester *requester
 }
 
-func (n *client5x) getLicense() (lic *LicenseInfo, err error) {
-	if n.edition == openSource {
+func (n *client5x) getLicense(ctx context.Context) (lic *LicenseInfo, err error) {
+	if edition(n.edition.Load()) == openSource {
 		return
 	}
 
@@ -22,7 +25,7 @@ func (n *client5x) getLicense() (lic *LicenseInfo, err error) {
 		MaxConnections int64  `json:"max_connections"`
 		ExpiryAt       string `json:"expiry_at"`
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v5/license", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/license"), &resp)
 	if err != nil {
 		return
 	}
@@ -40,7 +43,7 @@ func (n *client5x) getLicense() (lic *LicenseInfo, err error) {
 	return
 }
 
-func (n *client5x) getClusterStatus() (cluster ClusterStatus, err error) {
+func (n *client5x) getClusterStatus(ctx context.Context) (cluster ClusterStatus, err error) {
 	resp := []struct {
 		Version     string
 		Uptime      int64
@@ -53,7 +56,7 @@ func (n *client5x) getClusterStatus() (cluster ClusterStatus, err error) {
 		Load5       any `json:"load5"`
 		Load15      any `json:"load15"`
 	}{{}}
-	err = n.requester.callHTTPGetWithResp("/api/v5/nodes", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/nodes"), &resp)
 	if err != nil {
 		return
 	}
@@ -85,18 +88,18 @@ func (n *client5x) getClusterStatus() (cluster ClusterStatus, err error) {
 		cluster.CPULoads[nodeName] = cpuLoad
 
 		if data.Edition == "Enterprise" {
-			n.edition = enterprise
+			n.edition.Store(int32(enterprise))
 		}
 	}
 	return
 }
 
-func (n *client5x) getBrokerMetrics() (metrics *Broker, err error) {
+func (n *client5x) getBrokerMetrics(ctx context.Context) (metrics *Broker, err error) {
 	resp := struct {
 		SentMsgRate     int64 `json:"sent_msg_rate"`
 		ReceivedMsgRate int64 `json:"received_msg_rate"`
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v5/monitor_current", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/monitor_current"), &resp)
 	if err != nil {
 		return
 	}
@@ -108,7 +111,7 @@ func (n *client5x) getBrokerMetrics() (metrics *Broker, err error) {
 	return
 }
 
-func (n *client5x) getRuleEngineMetrics() (metrics []RuleEngine, err error) {
+func (n *client5x) getRuleEngineMetrics(ctx context.Context) (metrics []RuleEngine, err error) {
 	resp := struct {
 		Data []struct {
 			ID     string `json:"id"`
@@ -116,7 +119,7 @@ func (n *client5x) getRuleEngineMetrics() (metrics []RuleEngine, err error) {
 			Enable bool
 		}
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v5/rules", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/rules"), &resp)
 	if err != nil {
 		return
 	}
@@ -144,7 +147,7 @@ func (n *client5x) getRuleEngineMetrics() (metrics []RuleEngine, err error) {
 				}
 			} `json:"node_metrics"`
 		}{}
-		err = n.requester.callHTTPGetWithResp(fmt.Sprintf("/api/v5/rules/%s/metrics", rule.ID), &metricsResp)
+		err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/rules/:id/metrics", rule.ID), &metricsResp)
 		if err != nil {
 			return
 		}
@@ -171,13 +174,13 @@ func (n *client5x) getRuleEngineMetrics() (metrics []RuleEngine, err error) {
 	return
 }
 
-func (n *client5x) getDataBridge() (bridges []DataBridge, err error) {
+func (n *client5x) getDataBridge(ctx context.Context) (bridges []DataBridge, err error) {
 	bridgesResp := []struct {
 		Name   string
 		Type   string
 		Status string
 	}{{}}
-	err = n.requester.callHTTPGetWithResp("/api/v5/bridges", &bridgesResp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/bridges"), &bridgesResp)
 	if err != nil {
 		return
 	}
@@ -201,8 +204,10 @@ func (n *client5x) getDataBridge() (bridges []DataBridge, err error) {
 				Dropped    int64
 			}
 		}{}
-		err = n.requester.callHTTPGetWithResp(fmt.Sprintf("/api/v5/bridges/%s:%s/metrics", data.Type, data.Name), &metricsResp)
+		err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/bridges/:id/metrics", data.Type+":"+data.Name), &metricsResp)
 		if err != nil {
+			// Only the bridges with metrics are kept.
+			bridges = bridges[:i]
 			return
 		}
 		bridges[i].Queuing = metricsResp.Metrics.Queuing
@@ -214,13 +219,13 @@ func (n *client5x) getDataBridge() (bridges []DataBridge, err error) {
 	return
 }
 
-func (n *client5x) getAuthenticationMetrics() (dataSources []DataSource, metrics []Authentication, err error) {
+func (n *client5x) getAuthenticationMetrics(ctx context.Context) (dataSources []DataSource, metrics []Authentication, err error) {
 	resp := []struct {
 		ID      string `json:"id"`
 		Backend string
 		Enable  bool
 	}{{}}
-	err = n.requester.callHTTPGetWithResp("/api/v5/authentication", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/authentication"), &resp)
 	if err != nil {
 		return
 	}
@@ -244,7 +249,7 @@ func (n *client5x) getAuthenticationMetrics() (dataSources []DataSource, metrics
 			} `json:"node_metrics"`
 			Status string
 		}{}
-		err = n.requester.callHTTPGetWithResp(fmt.Sprintf("/api/v5/authentication/%s/status", plugin.ID), &status)
+		err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/authentication/:id/status", plugin.ID), &status)
 		if err != nil {
 			return
 		}
@@ -276,14 +281,14 @@ func (n *client5x) getAuthenticationMetrics() (dataSources []DataSource, metrics
 	return
 }
 
-func (n *client5x) getAuthorizationMetrics() (dataSources []DataSource, metrics []Authorization, err error) {
+func (n *client5x) getAuthorizationMetrics(ctx context.Context) (dataSources []DataSource, metrics []Authorization, err error) {
 	resp := struct {
 		Sources []struct {
 			Type   string
 			Enable bool
 		}
 	}{}
-	err = n.requester.callHTTPGetWithResp("/api/v5/authorization/sources", &resp)
+	err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/authorization/sources"), &resp)
 	if err != nil {
 		return
 	}
@@ -307,7 +312,7 @@ func (n *client5x) getAuthorizationMetrics() (dataSources []DataSource, metrics
 			} `json:"node_metrics"`
 			Status string
 		}{}
-		err = n.requester.callHTTPGetWithResp(fmt.Sprintf("/api/v5/authorization/sources/%s/status", plugin.Type), &status)
+		err = n.requester.callHTTPGetWithResp(ctx, endpoint("/api/v5/authorization/sources/:type/status", plugin.Type), &status)
 		if err != nil {
 			return
 		}
@@ -15,10 +15,14 @@
 package collector
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
@@ -40,31 +44,132 @@ var (
 		[]string{"collector"},
 		nil,
 	)
+	scrapeTimeoutDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_timeout"),
+		"emqx-exporter: Whether a collector ran out of the time of the scrape.",
+		[]string{"collector"},
+		nil,
+	)
+	scrapeLastSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "collector_last_success_timestamp_seconds"),
+		"emqx-exporter: The last time a collector succeeded in the background in unixtime.",
+		[]string{"collector"},
+		nil,
+	)
+)
+
+const (
+	defaultEnabled = true
+	// defaultDisabled = false
 )
 
 var (
-	factories = make(map[string]func(client *client) (Collector, error))
+	factories        = make(map[string]func(client *client) (Collector, error))
+	collectorDefault = make(map[string]bool)
+	collectorState   = make(map[string]*bool)
 )
 
-func registerCollector(collector string, factory func(client *client) (Collector, error)) {
+func registerCollector(collector string, isDefaultEnabled bool, factory func(client *client) (Collector, error)) {
 	factories[collector] = factory
+	collectorDefault[collector] = isDefaultEnabled
+	collectorState[collector] = &isDefaultEnabled
+}
+
+// AddFlags adds the flags to enable or disable each collector to the application,
+// e.g. --collector.rule and --no-collector.rule.
+func AddFlags(app *kingpin.Application) {
+	for _, collector := range sortedCollectors() {
+		var helpDefaultState string
+		if collectorDefault[collector] {
+			helpDefaultState = "enabled"
+		} else {
+			helpDefaultState = "disabled"
+		}
+
+		flagName := fmt.Sprintf("collector.%s", collector)
+		flagHelp := fmt.Sprintf("Enable the %s collector (default: %s).", collector, helpDefaultState)
+		defaultValue := fmt.Sprintf("%v", collectorDefault[collector])
+		collectorState[collector] = app.Flag(flagName, flagHelp).Default(defaultValue).Bool()
+	}
+}
+
+// ValidateCollectors returns an error if any of the collectors doesn't exist.
+func ValidateCollectors(collectors []string) error {
+	for _, collector := range collectors {
+		if _, ok := factories[collector]; !ok {
+			return fmt.Errorf("missing collector: %s", collector)
+		}
+	}
+	return nil
+}
+
+// enabledCollectors returns the collectors enabled by the list if it's not empty, otherwise by the flags.
+func enabledCollectors(list []string) []string {
+	if len(list) > 0 {
+		return list
+	}
+	var collectors []string
+	for _, collector := range sortedCollectors() {
+		if *collectorState[collector] {
+			collectors = append(collectors, collector)
+		}
+	}
+	return collectors
+}
+
+// filterCollectors returns the enabled collectors matching the filters, or all of them if no filter is given.
+func filterCollectors(enabled []string, filters []string) ([]string, error) {
+	if len(filters) == 0 {
+		return enabled, nil
+	}
+	for _, filter := range filters {
+		if _, ok := factories[filter]; !ok {
+			return nil, fmt.Errorf("missing collector: %s", filter)
+		}
+		found := false
+		for _, collector := range enabled {
+			if collector == filter {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("disabled collector: %s", filter)
+		}
+	}
+	return filters, nil
+}
+
+func sortedCollectors() []string {
+	collectors := make([]string, 0, len(factories))
+	for collector := range factories {
+		collectors = append(collectors, collector)
+	}
+	sort.Strings(collectors)
+	return collectors
 }
 
 // EMQXCollector implements the prometheus.Collector interface.
 type EMQXCollector struct {
 	Collectors map[string]Collector
 	logger     log.Logger
+	// snapshots are the metrics of the collectors refreshed in the background, it's nil unless the cache is started.
+	snapshots map[string]*snapshot
 }
 
-// NewEMQXCollector creates a new EMQXCollector.
-func NewEMQXCollector(client *client, logger log.Logger) (*EMQXCollector, error) {
+// NewEMQXCollector creates a new EMQXCollector with the given collectors.
+func NewEMQXCollector(client *client, logger log.Logger, names ...string) (*EMQXCollector, error) {
 	collectors := make(map[string]Collector)
-	for key, factory := range factories {
+	for _, name := range names {
+		factory, ok := factories[name]
+		if !ok {
+			return nil, fmt.Errorf("missing collector: %s", name)
+		}
 		collector, err := factory(client)
 		if err != nil {
 			return nil, err
 		}
-		collectors[key] = collector
+		collectors[name] = collector
 	}
 	return &EMQXCollector{Collectors: collectors, logger: logger}, nil
 }
@@ -73,46 +178,154 @@ func NewEMQXCollector(client *client, logger log.Logger) (*EMQXCollector, error)
 func (n EMQXCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- scrapeDurationDesc
 	ch <- scrapeSuccessDesc
+	ch <- scrapeTimeoutDesc
+	ch <- scrapeLastSuccessDesc
 }
 
-// Collect implements the prometheus.Collector interface.
+// Collect implements the prometheus.Collector interface, the collectors aren't limited in time.
 func (n EMQXCollector) Collect(ch chan<- prometheus.Metric) {
+	n.CollectContext(context.Background(), ch)
+}
+
+// CollectContext runs the collectors concurrently until ctx is done. The collectors which haven't finished by then
+// are abandoned, keeping the metrics they have sent, and reported by emqx_scrape_collector_timeout.
+// If the cache is started, the snapshots of the collectors are sent instead.
+func (n EMQXCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if n.snapshots != nil {
+		for name := range n.Collectors {
+			n.snapshots[name].collect(name, ch)
+		}
+		return
+	}
+
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
 	for name, c := range n.Collectors {
 		wg.Add(1)
 		go func(name string, c Collector) {
 			defer wg.Done()
-			execute(name, c, ch, n.logger)
+			execute(ctx, name, c, ch, n.logger).send(name, ch)
 		}(name, c)
 	}
 }
 
-func execute(name string, c Collector, ch chan<- prometheus.Metric, logger log.Logger) {
+// filter returns the collector of the named collectors, sharing the collectors and the snapshots of n.
+func (n *EMQXCollector) filter(names []string) (*EMQXCollector, error) {
+	collectors := make(map[string]Collector, len(names))
+	for _, name := range names {
+		c, ok := n.Collectors[name]
+		if !ok {
+			return nil, fmt.Errorf("disabled collector: %s", name)
+		}
+		collectors[name] = c
+	}
+	return &EMQXCollector{Collectors: collectors, logger: n.logger, snapshots: n.snapshots}, nil
+}
+
+// WithContext returns the collector which collects within ctx, it's meant to be registered for one scrape only.
+func (n *EMQXCollector) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{EMQXCollector: n, ctx: ctx}
+}
+
+type contextCollector struct {
+	*EMQXCollector
+	ctx context.Context
+}
+
+// Collect implements the prometheus.Collector interface.
+func (n *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	n.CollectContext(n.ctx, ch)
+}
+
+// result is the outcome of an update of a collector.
+type result struct {
+	duration time.Duration
+	success  bool
+	timeout  bool
+}
+
+func execute(ctx context.Context, name string, c Collector, ch chan<- prometheus.Metric, logger log.Logger) result {
 	begin := time.Now()
-	err := c.Update(ch)
-	duration := time.Since(begin)
-	var success float64
+	err := updateWithin(ctx, c, ch)
+	r := result{duration: time.Since(begin)}
+	duration := r.duration
 
-	if err != nil {
+	if isTimeout(ctx, err) {
+		level.Warn(logger).Log("msg", "collector ran out of time", "name", name, "duration_seconds", duration.Seconds(), "err", err)
+		r.timeout = true
+	} else if err != nil {
 		if IsNoDataError(err) {
 			level.Debug(logger).Log("msg", "collector returned no data", "name", name, "duration_seconds", duration.Seconds(), "err", err)
 		} else {
 			level.Error(logger).Log("msg", "collector failed", "name", name, "duration_seconds", duration.Seconds(), "err", err)
 		}
-		success = 0
 	} else {
 		level.Debug(logger).Log("msg", "collector succeeded", "name", name, "duration_seconds", duration.Seconds())
+		r.success = true
+	}
+	return r
+}
+
+// send sends the duration, success and timeout of the collector.
+func (r result) send(name string, ch chan<- prometheus.Metric) {
+	var success, timeout float64
+	if r.success {
 		success = 1
 	}
-	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+	if r.timeout {
+		timeout = 1
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, r.duration.Seconds(), name)
 	ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, name)
+	ch <- prometheus.MustNewConstMetric(scrapeTimeoutDesc, prometheus.GaugeValue, timeout, name)
+}
+
+// abandonDelay is how long the collectors have to return with the metrics they have fetched once ctx is done.
+const abandonDelay = 100 * time.Millisecond
+
+// updateWithin forwards the metrics of the collector to ch until the collector returns, or it's abandoned by
+// abandonDelay after ctx is done. The metrics sent by the abandoned collector are dropped, as ch may be closed
+// once the scrape has been gathered.
+func updateWithin(ctx context.Context, c Collector, ch chan<- prometheus.Metric) error {
+	metrics := make(chan prometheus.Metric)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Update(ctx, metrics)
+		close(metrics)
+	}()
+	done := ctx.Done()
+	var abandon <-chan time.Time
+	for {
+		select {
+		case m, ok := <-metrics:
+			if !ok {
+				return <-errCh
+			}
+			ch <- m
+		case <-done:
+			done = nil
+			timer := time.NewTimer(abandonDelay)
+			defer timer.Stop()
+			abandon = timer.C
+		case <-abandon:
+			go func() {
+				for range metrics {
+				}
+			}()
+			return ctx.Err()
+		}
+	}
+}
+
+// isTimeout returns whether the error is caused by running out of the time of ctx.
+func isTimeout(ctx context.Context, err error) bool {
+	return err != nil && (ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded))
 }
 
 // Collector is the interface a collector has to implement.
 type Collector interface {
-	// Get new metrics and expose them via prometheus registry.
-	Update(ch chan<- prometheus.Metric) error
+	// Get new metrics and expose them via prometheus registry, giving up once ctx is done.
+	Update(ctx context.Context, ch chan<- prometheus.Metric) error
 }
 
 // ErrNoData indicates the collector found no data to collect, but had no other error.
@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,7 +36,7 @@ const (
 )
 
 func init() {
-	registerCollector(AuthenticationSubsystem, NewAuthenticationCollector)
+	registerCollector(AuthenticationSubsystem, defaultEnabled, NewAuthenticationCollector)
 }
 
 type authenticationCollector struct {
@@ -113,8 +114,8 @@ func NewAuthenticationCollector(client *client) (Collector, error) {
 }
 
 // Update implements the Collector interface and will collect authentication metrics.
-func (c *authenticationCollector) Update(ch chan<- prometheus.Metric) error {
-	dataSources, metrics, err := doGetAuthenticationMetrics(c.client)
+func (c *authenticationCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	dataSources, metrics, err := doGetAuthenticationMetrics(ctx, c.client)
 	if err != nil {
 		return err
 	}
@@ -186,15 +187,12 @@ type DataSource struct {
 	Status  int
 }
 
-func doGetAuthenticationMetrics(c *client) (dataSources []DataSource, auths []Authentication, err error) {
-	c.Lock()
-	defer c.Unlock()
-
-	client := c.emqxClient
+func doGetAuthenticationMetrics(ctx context.Context, c *client) (dataSources []DataSource, auths []Authentication, err error) {
+	client := c.current()
 	if client == nil {
 		return
 	}
-	dataSources, auths, err = client.getAuthenticationMetrics()
+	dataSources, auths, err = client.getAuthenticationMetrics(ctx)
 	if err != nil {
 		err = fmt.Errorf("collect authentication metrics failed. %w", err)
 		return
@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,7 +36,7 @@ const (
 )
 
 func init() {
-	registerCollector(AuthorizationSubsystem, NewAuthorizationCollector)
+	registerCollector(AuthorizationSubsystem, defaultEnabled, NewAuthorizationCollector)
 }
 
 type AuthorizationCollector struct {
@@ -113,8 +114,8 @@ func NewAuthorizationCollector(client *client) (Collector, error) {
 }
 
 // Update implements the Collector interface and will collect authorization metrics.
-func (c *AuthorizationCollector) Update(ch chan<- prometheus.Metric) error {
-	dataSources, metrics, err := doGetAuthorizationMetrics(c.client)
+func (c *AuthorizationCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	dataSources, metrics, err := doGetAuthorizationMetrics(ctx, c.client)
 	if err != nil {
 		return err
 	}
@@ -181,14 +182,12 @@ type Authorization struct {
 	ExecTimeCost   map[string]uint64
 }
 
-func doGetAuthorizationMetrics(c *client) (dataSources []DataSource, auths []Authorization, err error) {
-	c.Lock()
-	defer c.Unlock()
-	client := c.emqxClient
+func doGetAuthorizationMetrics(ctx context.Context, c *client) (dataSources []DataSource, auths []Authorization, err error) {
+	client := c.current()
 	if client == nil {
 		return
 	}
-	dataSources, auths, err = client.getAuthorizationMetrics()
+	dataSources, auths, err = client.getAuthorizationMetrics(ctx)
 	if err != nil {
 		err = fmt.Errorf("collect authorization metrics failed. %w", err)
 		return
@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -31,7 +32,7 @@ const (
 )
 
 func init() {
-	registerCollector(clusterStatusSubsystem, NewClusterStatusCollector)
+	registerCollector(clusterStatusSubsystem, defaultEnabled, NewClusterStatusCollector)
 }
 
 type clusterStatusCollector struct {
@@ -88,8 +89,8 @@ func NewClusterStatusCollector(client *client) (Collector, error) {
 }
 
 // Update implements the Collector interface and will collect cluster status.
-func (c *clusterStatusCollector) Update(ch chan<- prometheus.Metric) error {
-	status, err := doGetClusterStatus(c.client)
+func (c *clusterStatusCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	status, err := doGetClusterStatus(ctx, c.client)
 	if err != nil {
 		return err
 	}
@@ -140,14 +141,12 @@ type CPULoad struct {
 	Load15 float64
 }
 
-func doGetClusterStatus(c *client) (status ClusterStatus, err error) {
-	c.Lock()
-	defer c.Unlock()
-	client := c.emqxClient
+func doGetClusterStatus(ctx context.Context, c *client) (status ClusterStatus, err error) {
+	client := c.current()
 	if client == nil {
 		return
 	}
-	status, err = client.getClusterStatus()
+	status, err = client.getClusterStatus(ctx)
 	if err != nil {
 		err = fmt.Errorf("collect cluster status failed. %w", err)
 		return
@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"time"
@@ -32,9 +33,12 @@ const (
 )
 
 func init() {
-	registerCollector(LicenseSubsystem, NewLicenseCollector)
+	registerCollector(LicenseSubsystem, defaultEnabled, NewLicenseCollector)
 }
 
+// timeNow is used to calculate the remaining days of license, it's replaced in tests.
+var timeNow = time.Now
+
 type licenseCollector struct {
 	desc   map[string]*prometheus.Desc
 	client *client
@@ -81,8 +85,8 @@ func NewLicenseCollector(client *client) (Collector, error) {
 }
 
 // Update implements the Collector interface and will collect license info.
-func (c *licenseCollector) Update(ch chan<- prometheus.Metric) error {
-	lic, err := doGetLicense(c.client)
+func (c *licenseCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	lic, err := doGetLicense(ctx, c.client)
 	if err != nil {
 		return err
 	}
@@ -113,19 +117,17 @@ type LicenseInfo struct {
 	RemainingDays  float64
 }
 
-func doGetLicense(c *client) (lic *LicenseInfo, err error) {
-	c.Lock()
-	defer c.Unlock()
-	client := c.emqxClient
+func doGetLicense(ctx context.Context, c *client) (lic *LicenseInfo, err error) {
+	client := c.current()
 	if client == nil {
 		return
 	}
-	lic, err = client.getLicense()
+	lic, err = client.getLicense(ctx)
 	if err != nil || lic == nil {
 		return
 	}
 
-	lic.RemainingDays = time.Until(time.UnixMilli(lic.Expiration)).Hours() / 24
+	lic.RemainingDays = time.UnixMilli(lic.Expiration).Sub(timeNow()).Hours() / 24
 	lic.RemainingDays, _ = strconv.ParseFloat(fmt.Sprintf("%.1f", lic.RemainingDays), 64)
 	return
 }
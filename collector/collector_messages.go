@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -30,7 +31,7 @@ const (
 )
 
 func init() {
-	registerCollector(BrokerSubsystem, NewBrokerCollector)
+	registerCollector(BrokerSubsystem, defaultEnabled, NewBrokerCollector)
 }
 
 type brokerCollector struct {
@@ -79,8 +80,8 @@ func NewBrokerCollector(client *client) (Collector, error) {
 }
 
 // Update implements the Collector interface and will collect license info.
-func (c *brokerCollector) Update(ch chan<- prometheus.Metric) error {
-	metrics, err := doGetBrokerMetrics(c.client)
+func (c *brokerCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	metrics, err := doGetBrokerMetrics(ctx, c.client)
 	if err != nil {
 		return err
 	}
@@ -115,14 +116,12 @@ type Broker struct {
 	MsgOutputPeriodSec  int64
 }
 
-func doGetBrokerMetrics(c *client) (brokers *Broker, err error) {
-	c.Lock()
-	defer c.Unlock()
-	client := c.emqxClient
+func doGetBrokerMetrics(ctx context.Context, c *client) (brokers *Broker, err error) {
+	client := c.current()
 	if client == nil {
 		return
 	}
-	brokers, err = client.getBrokerMetrics()
+	brokers, err = client.getBrokerMetrics(ctx)
 	if err != nil {
 		err = fmt.Errorf("collect broker metrics failed. %w", err)
 		return
@@ -14,6 +14,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -46,7 +47,7 @@ const (
 )
 
 func init() {
-	registerCollector(RuleEngineSubsystem, NewRuleEngineCollector)
+	registerCollector(RuleEngineSubsystem, defaultEnabled, NewRuleEngineCollector)
 }
 
 type ruleEngineCollector struct {
@@ -174,9 +175,10 @@ func NewRuleEngineCollector(client *client) (Collector, error) {
 }
 
 // Update implements the Collector interface and will collect rule engine metrics.
-func (c *ruleEngineCollector) Update(ch chan<- prometheus.Metric) error {
-	bridges, metrics, err := doGetRuleEngineMetrics(c.client)
-	if err != nil {
+func (c *ruleEngineCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	bridges, metrics, err := doGetRuleEngineMetrics(ctx, c.client)
+	// The rules and bridges fetched before running out of time are exposed with the error.
+	if err != nil && !isTimeout(ctx, err) {
 		return err
 	}
 
@@ -264,7 +266,7 @@ func (c *ruleEngineCollector) Update(ch chan<- prometheus.Metric) error {
 			prometheus.CounterValue, float64(bridges[i].Dropped), bridges[i].Type, bridges[i].Name,
 		)
 	}
-	return nil
+	return err
 }
 
 type DataBridge struct {
@@ -300,19 +302,17 @@ type RuleEngine struct {
 	ActionExecTimeCost map[string]uint64
 }
 
-func doGetRuleEngineMetrics(c *client) (bridges []DataBridge, res []RuleEngine, err error) {
-	c.Lock()
-	defer c.Unlock()
-	client := c.emqxClient
+func doGetRuleEngineMetrics(ctx context.Context, c *client) (bridges []DataBridge, res []RuleEngine, err error) {
+	client := c.current()
 	if client == nil {
 		return
 	}
-	bridges, err = client.getDataBridge()
+	bridges, err = client.getDataBridge(ctx)
 	if err != nil {
 		err = fmt.Errorf("collect rule engine data bridge failed. %w", err)
 		return
 	}
-	res, err = client.getRuleEngineMetrics()
+	res, err = client.getRuleEngineMetrics(ctx)
 	if err != nil {
 		err = fmt.Errorf("collect rule engine metrics failed. %w", err)
 		return
@@ -0,0 +1,564 @@
+package collector
+
+import (
+	"emqx-exporter/collector/emqxtest"
+	"emqx-exporter/config"
+
+	"bytes"
+	"context"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata")
+
+// newTestClient returns a client of the fake server of the metrics config once the version of EMQX is detected.
+func newTestClient(t *testing.T, metrics *config.Metrics) *client {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	c := newClient(ctx, metrics, nil, log.NewNopLogger())
+	waitForClient(t, c)
+	return c
+}
+
+// waitForClient waits until the version of EMQX is detected by the client.
+func waitForClient(t *testing.T, c *client) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if c.current() != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Couldn't detect the version of the fake server")
+}
+
+// scrape returns the exposition of the collectors, without the durations of scrape which aren't stable.
+func scrape(t *testing.T, c *client, names ...string) string {
+	t.Helper()
+	return scrapeWithin(t, context.Background(), c, names...)
+}
+
+// scrapeWithin is scrape limited by ctx.
+func scrapeWithin(t *testing.T, ctx context.Context, c *client, names ...string) string {
+	t.Helper()
+	nc, err := NewEMQXCollector(c, log.NewNopLogger(), names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gather(t, nc.WithContext(ctx))
+}
+
+// gather returns the exposition of the collector, without the durations of scrape which aren't stable.
+func gather(t *testing.T, collector prometheus.Collector) string {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if mf.GetName() == "emqx_scrape_collector_duration_seconds" {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func TestCollectorsGolden(t *testing.T) {
+	timeNow = func() time.Time { return time.Date(2030, 5, 1, 0, 0, 0, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	for _, version := range []emqxtest.Version{emqxtest.V4, emqxtest.V5} {
+		t.Run(version.String(), func(t *testing.T) {
+			server := emqxtest.NewServer(version)
+			defer server.Close()
+			c := newTestClient(t, server.Metrics())
+
+			for _, name := range sortedCollectors() {
+				t.Run(name, func(t *testing.T) {
+					got := scrape(t, c, name)
+					golden := filepath.Join("testdata", version.String(), name+".prom")
+					if *update {
+						if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+							t.Fatal(err)
+						}
+						if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+							t.Fatal(err)
+						}
+					}
+					expected, err := os.ReadFile(golden)
+					if err != nil {
+						t.Fatalf("%s, run the tests with -update to create it", err)
+					}
+					if got != string(expected) {
+						t.Errorf("The exposition doesn't match %s, got:\n%s", golden, got)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestCollectorsErrorInjection(t *testing.T) {
+	testcases := []struct {
+		name   string
+		inject func(s *emqxtest.Server, path string)
+	}{
+		{
+			name: "http 500",
+			inject: func(s *emqxtest.Server, path string) {
+				s.SetStatusError(path, http.StatusInternalServerError)
+			},
+		},
+		{
+			name: "http 503",
+			inject: func(s *emqxtest.Server, path string) {
+				s.SetStatusError(path, http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "code field",
+			inject: func(s *emqxtest.Server, path string) {
+				s.SetCodeError(path, "INTERNAL_ERROR", "something went wrong")
+			},
+		},
+		{
+			name: "invalid json",
+			inject: func(s *emqxtest.Server, path string) {
+				s.SetInvalidJSON(path)
+			},
+		},
+		{
+			name: "not found",
+			inject: func(s *emqxtest.Server, path string) {
+				s.Remove(path)
+			},
+		},
+	}
+
+	endpoints := map[string]string{
+		clusterStatusSubsystem:  "/api/v5/nodes",
+		LicenseSubsystem:        "/api/v5/license",
+		BrokerSubsystem:         "/api/v5/monitor_current",
+		RuleEngineSubsystem:     "/api/v5/rules/rule_test/metrics",
+		AuthenticationSubsystem: "/api/v5/authentication/password_based:built_in_database/status",
+		AuthorizationSubsystem:  "/api/v5/authorization/sources/file/status",
+	}
+
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	c := newTestClient(t, server.Metrics())
+
+	for name, path := range endpoints {
+		for _, tc := range testcases {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				defer server.Reset()
+				tc.inject(server, path)
+
+				got := scrape(t, c, name)
+				if !strings.Contains(got, `emqx_scrape_collector_success{collector="`+name+`"} 0`) {
+					t.Errorf("Expected the collector to fail, got:\n%s", got)
+				}
+				if server.Requests(path) == 0 {
+					t.Errorf("Expected %s to be requested", path)
+				}
+			})
+		}
+	}
+}
+
+func TestCollectorsSlowResponse(t *testing.T) {
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	c := newTestClient(t, server.Metrics())
+
+	delay := 200 * time.Millisecond
+	server.SetDelay("/api/v5/monitor_current", delay)
+
+	begin := time.Now()
+	got := scrape(t, c, BrokerSubsystem)
+	if time.Since(begin) < delay {
+		t.Errorf("Expected the scrape to take at least %s", delay)
+	}
+	if !strings.Contains(got, `emqx_scrape_collector_success{collector="messages"} 1`) {
+		t.Errorf("Expected the collector to succeed, got:\n%s", got)
+	}
+}
+
+func TestCollectorsConcurrency(t *testing.T) {
+	delay := 300 * time.Millisecond
+	testcases := []struct {
+		name                  string
+		maxConcurrentRequests int
+		// concurrent is whether the slow requests of the collectors are in flight at the same time.
+		concurrent bool
+	}{
+		{
+			name:       "default",
+			concurrent: true,
+		},
+		{
+			name:                  "one request in flight",
+			maxConcurrentRequests: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := emqxtest.NewServer(emqxtest.V5)
+			defer server.Close()
+			metrics := server.Metrics()
+			metrics.MaxConcurrentRequests = tc.maxConcurrentRequests
+			c := newTestClient(t, metrics)
+
+			server.SetDelay("/api/v5/monitor_current", delay)
+			server.SetDelay("/api/v5/license", delay)
+
+			begin := time.Now()
+			got := scrape(t, c, BrokerSubsystem, LicenseSubsystem)
+			elapsed := time.Since(begin)
+			if tc.concurrent && elapsed >= 2*delay {
+				t.Errorf("Expected the collectors to fetch concurrently, but the scrape took %s", elapsed)
+			}
+			if !tc.concurrent && elapsed < 2*delay {
+				t.Errorf("Expected the requests to be serialized, but the scrape took %s", elapsed)
+			}
+			for _, collector := range []string{BrokerSubsystem, LicenseSubsystem} {
+				if expected := `emqx_scrape_collector_success{collector="` + collector + `"} 1`; !strings.Contains(got, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectorsTimeout(t *testing.T) {
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	c := newTestClient(t, server.Metrics())
+
+	delay := 2 * time.Second
+	server.SetDelay("/api/v5/monitor_current", delay)
+	server.SetDelay("/api/v5/bridges/kafka:backup/metrics", delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	got := scrapeWithin(t, ctx, c, BrokerSubsystem, clusterStatusSubsystem, RuleEngineSubsystem)
+	if elapsed := time.Since(begin); elapsed >= delay {
+		t.Errorf("Expected the scrape to end by the deadline, but it took %s", elapsed)
+	}
+
+	for _, expected := range []string{
+		`emqx_scrape_collector_timeout{collector="messages"} 1`,
+		`emqx_scrape_collector_success{collector="messages"} 0`,
+		`emqx_scrape_collector_timeout{collector="cluster"} 0`,
+		`emqx_scrape_collector_success{collector="cluster"} 1`,
+		`emqx_scrape_collector_timeout{collector="rule"} 1`,
+		// The bridge fetched before running out of time is exposed.
+		`emqx_rule_bridge_queuing{name="public_broker",type="mqtt"} 3`,
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, got)
+		}
+	}
+	if strings.Contains(got, `name="backup"`) {
+		t.Errorf("Expected the bridge without metrics to be dropped, got:\n%s", got)
+	}
+}
+
+func TestCollectorsCache(t *testing.T) {
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	c := newTestClient(t, server.Metrics())
+	nc, err := NewEMQXCollector(c, log.NewNopLogger(), BrokerSubsystem, clusterStatusSubsystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nc.startCache(ctx, c, &config.CacheConfig{Interval: 1, Intervals: map[string]int64{clusterStatusSubsystem: 60}})
+
+	// waitFor gathers the collector until the exposition contains all the expected strings.
+	waitFor := func(expected ...string) string {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			got := gather(t, nc)
+			found := true
+			for _, s := range expected {
+				found = found && strings.Contains(got, s)
+			}
+			if found {
+				return got
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %v, got:\n%s", expected, got)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	waitFor(`emqx_scrape_collector_success{collector="messages"} 1`, `emqx_scrape_collector_success{collector="cluster"} 1`)
+	requests := server.Requests("/api/v5/nodes")
+	for i := 0; i < 3; i++ {
+		got := gather(t, nc)
+		for _, expected := range []string{
+			`emqx_messages_input_period_second 80`,
+			`emqx_scrape_collector_last_success_timestamp_seconds{collector="messages"}`,
+			`emqx_cluster_status 2`,
+		} {
+			if !strings.Contains(got, expected) {
+				t.Errorf("Expected %s, got:\n%s", expected, got)
+			}
+		}
+	}
+	if n := server.Requests("/api/v5/nodes"); n != requests {
+		t.Errorf("Expected the snapshot to be served without requests, but %d requests are made", n-requests)
+	}
+
+	// The snapshot is served until it's stale, 3 times the interval by default.
+	server.SetStatusError("/api/v5/monitor_current", http.StatusInternalServerError)
+	got := waitFor(`emqx_scrape_collector_success{collector="messages"} 0`)
+	if !strings.Contains(got, `emqx_messages_input_period_second 80`) {
+		t.Errorf("Expected the snapshot to be served after a failure, got:\n%s", got)
+	}
+	got = waitFor(`emqx_scrape_collector_last_success_timestamp_seconds{collector="messages"}`)
+	for deadline := time.Now().Add(10 * time.Second); strings.Contains(got, `emqx_messages_input_period_second`); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the stale snapshot to be dropped, got:\n%s", got)
+		}
+		time.Sleep(100 * time.Millisecond)
+		got = gather(t, nc)
+	}
+	if !strings.Contains(got, `emqx_scrape_collector_last_success_timestamp_seconds{collector="messages"}`) {
+		t.Errorf("Expected the time of the last success, got:\n%s", got)
+	}
+}
+
+func TestCollectorsHTTPConfig(t *testing.T) {
+	t.Run("headers", func(t *testing.T) {
+		server := emqxtest.NewServer(emqxtest.V5)
+		defer server.Close()
+		metrics := server.Metrics()
+		metrics.HTTP = config.DefaultHTTPClientConfig(config.DefaultMaxConcurrentRequests)
+		metrics.HTTP.Headers = map[string]config.Secret{"X-Gateway-Token": "token"}
+		metrics.HTTP.UserAgent = "exporter-test"
+		newTestClient(t, metrics)
+
+		header := server.Header("/api/v5/nodes")
+		if got := header.Get("X-Gateway-Token"); got != "token" {
+			t.Errorf("Expected the header X-Gateway-Token: token, got %q", got)
+		}
+		if got := header.Get("User-Agent"); got != "exporter-test" {
+			t.Errorf("Expected the User-Agent exporter-test, got %q", got)
+		}
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		server := emqxtest.NewServer(emqxtest.V5)
+		defer server.Close()
+		proxy := emqxtest.NewProxy()
+		defer proxy.Close()
+		metrics := server.Metrics()
+		metrics.HTTP = config.DefaultHTTPClientConfig(config.DefaultMaxConcurrentRequests)
+		metrics.HTTP.ProxyURL = config.SecretURL(proxy.URL)
+		newTestClient(t, metrics)
+
+		if proxy.Tunnels() == 0 {
+			t.Error("Expected the requests to be tunneled by the proxy")
+		}
+	})
+
+	t.Run("proxy credentials", func(t *testing.T) {
+		server := emqxtest.NewServer(emqxtest.V5)
+		defer server.Close()
+		proxy := emqxtest.NewProxy()
+		defer proxy.Close()
+		// The reserved characters are percent-encoded in the URL, and sent as they are by the proxy authorization.
+		proxy.RequireAuth("us@r", "p@ss:w%rd/")
+		proxyURL, err := url.Parse(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyURL.User = url.UserPassword("us@r", "p@ss:w%rd/")
+		metrics := server.Metrics()
+		metrics.HTTP = config.DefaultHTTPClientConfig(config.DefaultMaxConcurrentRequests)
+		metrics.HTTP.ProxyURL = config.SecretURL(proxyURL.String())
+		newTestClient(t, metrics)
+
+		if proxy.Tunnels() == 0 {
+			t.Error("Expected the requests to be tunneled by the proxy with the credentials")
+		}
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		server := emqxtest.NewServer(emqxtest.V5)
+		defer server.Close()
+		metrics := server.Metrics()
+		metrics.HTTP = config.DefaultHTTPClientConfig(config.DefaultMaxConcurrentRequests)
+		metrics.HTTP.Retries = 2
+		metrics.HTTP.RetryBackoff = 0.05
+		c := newTestClient(t, metrics)
+
+		server.SetStatusError("/api/v5/monitor_current", http.StatusServiceUnavailable)
+		server.SetStatusError("/api/v5/license", http.StatusForbidden)
+		begin := time.Now()
+		got := scrape(t, c, BrokerSubsystem, LicenseSubsystem)
+		// The backoff is doubled for the second retry.
+		if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+			t.Errorf("Expected the retries to back off, but the scrape took %s", elapsed)
+		}
+		if n := server.Requests("/api/v5/monitor_current"); n != 3 {
+			t.Errorf("Expected the 5xx response to be retried twice, but it's requested %d times", n)
+		}
+		if n := server.Requests("/api/v5/license"); n != 1 {
+			t.Errorf("Expected the 4xx response not to be retried, but it's requested %d times", n)
+		}
+		if !strings.Contains(got, `emqx_scrape_collector_success{collector="messages"} 0`) {
+			t.Errorf("Expected the collector to fail, got:\n%s", got)
+		}
+	})
+}
+
+func TestEndpoint(t *testing.T) {
+	testcases := []struct {
+		template string
+		params   []string
+		path     string
+	}{
+		{template: "/api/v5/nodes", path: "/api/v5/nodes"},
+		{template: "/api/v5/rules/:id/metrics", params: []string{"rule_test"}, path: "/api/v5/rules/rule_test/metrics"},
+		{template: "/api/v5/bridges/:id/metrics", params: []string{"mqtt:public_broker"}, path: "/api/v5/bridges/mqtt:public_broker/metrics"},
+		{template: "/api/v5/:a/:b", params: []string{"x", "y"}, path: "/api/v5/x/y"},
+	}
+	for _, tc := range testcases {
+		p := endpoint(tc.template, tc.params...)
+		if p.endpoint != tc.template || p.path != tc.path {
+			t.Errorf("Expected endpoint %s with path %s but got %s with %s", tc.template, tc.path, p.endpoint, p.path)
+		}
+	}
+}
+
+func TestCollectorsAPIMetrics(t *testing.T) {
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	metrics := server.Metrics()
+	metrics.Name = "emqx-test"
+	apiMetrics := newAPIMetrics(nil)
+	c := newClient(ctx, metrics, apiMetrics, log.NewNopLogger())
+	waitForClient(t, c)
+
+	server.SetStatusError("/api/v5/license", http.StatusForbidden)
+	scrape(t, c, RuleEngineSubsystem, LicenseSubsystem)
+	requests := gather(t, apiMetrics.requests)
+	for _, expected := range []string{
+		// The parameters of the endpoints aren't exposed, the requests of both bridges are counted together.
+		`emqx_exporter_api_requests_total{cluster="emqx-test",endpoint="/api/v5/bridges/:id/metrics",status_code="200"} 2`,
+		`emqx_exporter_api_requests_total{cluster="emqx-test",endpoint="/api/v5/rules/:id/metrics",status_code="200"} 1`,
+		`emqx_exporter_api_requests_total{cluster="emqx-test",endpoint="/api/v5/license",status_code="403"} 1`,
+	} {
+		if !strings.Contains(requests, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, requests)
+		}
+	}
+	if strings.Contains(requests, "rule_test") || strings.Contains(requests, "public_broker") {
+		t.Errorf("Expected the endpoints to be templated, got:\n%s", requests)
+	}
+	duration := gather(t, apiMetrics.duration)
+	if expected := `emqx_exporter_api_request_duration_seconds_count{cluster="emqx-test",endpoint="/api/v5/rules"} 1`; !strings.Contains(duration, expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, duration)
+	}
+}
+
+func TestCollectorsTLS(t *testing.T) {
+	testcases := []struct {
+		name     string
+		modify   func(m *config.Metrics)
+		detected bool
+		verified string
+	}{
+		{
+			name:     "verified",
+			detected: true,
+			verified: "1",
+		},
+		{
+			name:     "insecure skip verify",
+			modify:   func(m *config.Metrics) { m.TLSClientConfig = &config.TLSClientConfig{InsecureSkipVerify: true} },
+			detected: true,
+			verified: "0",
+		},
+		{
+			name:     "unknown ca",
+			modify:   func(m *config.Metrics) { m.TLSClientConfig = &config.TLSClientConfig{} },
+			verified: "0",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := emqxtest.NewTLSServer(emqxtest.V5)
+			defer server.Close()
+			metrics := server.Metrics()
+			if tc.modify != nil {
+				tc.modify(metrics)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := newClient(ctx, metrics, nil, log.NewNopLogger())
+
+			// The handshake is recorded even if it's refused, and the version is detected unless it's refused.
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				detected := c.current() != nil
+				if detected && !tc.detected {
+					t.Fatal("Expected the requests to be refused")
+				}
+				if detected == tc.detected && strings.Contains(scrape(t, c, TLSSubsystem), "emqx_tls_chain_verified") {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("Expected the handshake with the server")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			got := scrape(t, c, TLSSubsystem)
+			serverName := `server_name="127.0.0.1"`
+			for _, expected := range []string{
+				`emqx_tls_chain_verified{` + serverName + `} ` + tc.verified,
+				`emqx_tls_cert_info{issuer="O=Acme Co",san="example.com,`,
+				`emqx_tls_version_info{` + serverName + `,version="TLS 1.3"} 1`,
+				`emqx_tls_cert_not_after_seconds{issuer="O=Acme Co",serial_number=`,
+				`emqx_scrape_collector_success{collector="tls"} 1`,
+			} {
+				if !strings.Contains(got, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, got)
+				}
+			}
+		})
+	}
+}
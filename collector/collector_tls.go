@@ -0,0 +1,48 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"emqx-exporter/tlsinfo"
+
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	TLSSubsystem = "tls"
+)
+
+func init() {
+	registerCollector(TLSSubsystem, defaultEnabled, NewTLSCollector)
+}
+
+// tlsCollector exposes the certificates of the API of EMQX and the negotiated TLS parameters,
+// which are recorded by the handshakes of the requests of the other collectors.
+type tlsCollector struct {
+	tls *tlsinfo.Collector
+}
+
+// NewTLSCollector returns a new TLS based collector
+func NewTLSCollector(client *client) (Collector, error) {
+	return &tlsCollector{tls: tlsinfo.NewCollector(client.tls, nil)}, nil
+}
+
+// Update implements the Collector interface and will collect the last TLS handshakes, nothing is
+// collected if the API isn't scraped over TLS.
+func (c *tlsCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	c.tls.Collect(ch)
+	return nil
+}
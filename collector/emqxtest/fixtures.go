@@ -0,0 +1,259 @@
+package emqxtest
+
+// v4Fixtures are the responses of the EMQX 4.4 enterprise endpoints used by the exporter, keyed by path.
+var v4Fixtures = map[string]string{
+	"/api/v4/nodes": `{
+  "code": 0,
+  "data": [
+    {
+      "version": "4.4.19",
+      "uptime": "2 days, 19 hours, 41 minutes, 47 seconds",
+      "node_status": "Running",
+      "node": "emqx@10.0.0.1",
+      "max_fds": 1048576,
+      "connections": 10,
+      "load1": "1.25",
+      "load5": "0.98",
+      "load15": "0.5"
+    },
+    {
+      "version": "4.4.19",
+      "uptime": "19 hours, 41 minutes, 7 seconds",
+      "node_status": "Running",
+      "node": "emqx@10.0.0.2",
+      "max_fds": 65536,
+      "connections": 5,
+      "load1": "0.1",
+      "load5": "0.2",
+      "load15": "0.3"
+    }
+  ]
+}`,
+	"/api/v4/license": `{
+  "code": 0,
+  "data": {
+    "max_connections": 100000,
+    "expiry_at": "2030-06-01 00:00:00"
+  }
+}`,
+	"/api/v4/monitor/current_metrics": `{
+  "code": 0,
+  "data": {
+    "sent": 120,
+    "received": 80
+  }
+}`,
+	"/api/v4/rules": `{
+  "code": 0,
+  "data": [
+    {
+      "id": "rule:1",
+      "enabled": true,
+      "metrics": [
+        {
+          "node": "emqx@10.0.0.1",
+          "speed_max": 10.5,
+          "speed_last5m": 2.5,
+          "speed": 1.5,
+          "matched": 100,
+          "passed": 90,
+          "no_result": 4,
+          "exception": 6,
+          "failed": 10
+        }
+      ],
+      "actions": [
+        {
+          "metrics": [
+            {
+              "node": "emqx@10.0.0.1",
+              "taken": 90,
+              "success": 88,
+              "failed": 2
+            }
+          ]
+        }
+      ]
+    },
+    {
+      "id": "rule:2",
+      "enabled": false,
+      "metrics": [],
+      "actions": []
+    }
+  ]
+}`,
+	"/api/v4/resources": `{
+  "code": 0,
+  "data": [
+    {
+      "id": "resource:kafka",
+      "type": "bridge_kafka",
+      "status": true
+    },
+    {
+      "id": "resource:webhook",
+      "type": "web_hook",
+      "status": false
+    }
+  ]
+}`,
+}
+
+// v5Fixtures are the responses of the EMQX 5 enterprise endpoints used by the exporter, keyed by path.
+var v5Fixtures = map[string]string{
+	"/api/v5/nodes": `[
+  {
+    "version": "5.3.0",
+    "uptime": 3600000,
+    "node_status": "running",
+    "node": "emqx@10.0.0.1",
+    "max_fds": 1048576,
+    "connections": 10,
+    "edition": "Enterprise",
+    "load1": 1.25,
+    "load5": 0.98,
+    "load15": 0.5
+  },
+  {
+    "version": "5.3.0",
+    "uptime": 7200000,
+    "node_status": "stopped",
+    "node": "emqx@emqx-core-1.emqx-headless.default.svc.cluster.local",
+    "max_fds": 65536,
+    "connections": 0,
+    "edition": "Enterprise",
+    "load1": "0.1",
+    "load5": "0.2",
+    "load15": "0.3"
+  }
+]`,
+	"/api/v5/license": `{
+  "max_connections": 100000,
+  "expiry_at": "2030-06-01"
+}`,
+	"/api/v5/monitor_current": `{
+  "sent_msg_rate": 120,
+  "received_msg_rate": 80
+}`,
+	"/api/v5/rules": `{
+  "data": [
+    {
+      "id": "rule_test",
+      "name": "test",
+      "enable": true
+    },
+    {
+      "id": "rule_disabled",
+      "name": "disabled",
+      "enable": false
+    }
+  ]
+}`,
+	"/api/v5/rules/rule_test/metrics": `{
+  "node_metrics": [
+    {
+      "node": "emqx@10.0.0.1",
+      "metrics": {
+        "matched.rate": 1.5,
+        "matched.rate.last5m": 2.5,
+        "matched.rate.max": 10.5,
+        "matched": 100,
+        "passed": 90,
+        "failed": 10,
+        "failed.exception": 6,
+        "failed.no_result": 4,
+        "actions.total": 90,
+        "actions.success": 88,
+        "actions.failed": 2
+      }
+    }
+  ]
+}`,
+	"/api/v5/bridges": `[
+  {
+    "name": "public_broker",
+    "type": "mqtt",
+    "status": "connected"
+  },
+  {
+    "name": "backup",
+    "type": "kafka",
+    "status": "disconnected"
+  }
+]`,
+	"/api/v5/bridges/mqtt:public_broker/metrics": `{
+  "metrics": {
+    "queuing": 3,
+    "rate_last5m": 1.5,
+    "rate_max": 12.5,
+    "failed": 2,
+    "dropped": 1
+  }
+}`,
+	"/api/v5/bridges/kafka:backup/metrics": `{
+  "metrics": {
+    "queuing": 0,
+    "rate_last5m": 0,
+    "rate_max": 0,
+    "failed": 0,
+    "dropped": 0
+  }
+}`,
+	"/api/v5/authentication": `[
+  {
+    "id": "password_based:built_in_database",
+    "backend": "built_in_database",
+    "enable": true
+  },
+  {
+    "id": "password_based:redis",
+    "backend": "redis",
+    "enable": false
+  }
+]`,
+	"/api/v5/authentication/password_based:built_in_database/status": `{
+  "status": "connected",
+  "node_metrics": [
+    {
+      "node": "emqx@10.0.0.1",
+      "metrics": {
+        "total": 50,
+        "success": 45,
+        "failed": 5,
+        "rate": 0.5,
+        "rate_last5m": 0.4,
+        "rate_max": 3.0
+      }
+    }
+  ]
+}`,
+	"/api/v5/authorization/sources": `{
+  "sources": [
+    {
+      "type": "file",
+      "enable": true
+    },
+    {
+      "type": "http",
+      "enable": false
+    }
+  ]
+}`,
+	"/api/v5/authorization/sources/file/status": `{
+  "status": "connected",
+  "node_metrics": [
+    {
+      "node": "emqx@10.0.0.1",
+      "metrics": {
+        "total": 30,
+        "allow": 25,
+        "deny": 5,
+        "rate": 0.3,
+        "rate_last5m": 0.2,
+        "rate_max": 1.0
+      }
+    }
+  ]
+}`,
+}
@@ -0,0 +1,54 @@
+package emqxtest
+
+import (
+	"emqx-exporter/internal/tunneltest"
+
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Proxy is an HTTP proxy which tunnels the CONNECT requests, it responds the other requests with 405.
+type Proxy struct {
+	*httptest.Server
+	tunnel tunneltest.Tunneler
+
+	mtx sync.Mutex
+	// auth is the expected Proxy-Authorization, empty if the proxy requires no authentication.
+	auth string
+}
+
+// NewProxy starts a proxy, it should be closed by Close.
+func NewProxy() *Proxy {
+	p := &Proxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	return p
+}
+
+// RequireAuth scripts the proxy to respond the CONNECT requests without the basic credentials with 407.
+func (p *Proxy) RequireAuth(username, password string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// Tunnels returns the number of the CONNECT requests tunneled by the proxy.
+func (p *Proxy) Tunnels() int {
+	return p.tunnel.Tunnels()
+}
+
+func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	p.mtx.Lock()
+	auth := p.auth
+	p.mtx.Unlock()
+	if auth != "" && r.Header.Get("Proxy-Authorization") != auth {
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	p.tunnel.Tunnel(w, r)
+}
@@ -0,0 +1,223 @@
+// Package emqxtest provides a fake of the EMQX management API for hermetic tests.
+package emqxtest
+
+import (
+	"emqx-exporter/config"
+
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+const (
+	// APIKey is the API key accepted by the fake server.
+	APIKey = "emqx_exporter_test_key"
+	// APISecret is the API secret accepted by the fake server.
+	APISecret = "emqx_exporter_test_secret"
+)
+
+// Version is the version of the EMQX management API to fake.
+type Version int
+
+const (
+	// V4 fakes the `/api/v4/*` endpoints of EMQX 4.4 enterprise.
+	V4 Version = iota
+	// V5 fakes the `/api/v5/*` endpoints of EMQX 5 enterprise.
+	V5
+)
+
+func (v Version) String() string {
+	switch v {
+	case V4:
+		return "v4"
+	case V5:
+		return "v5"
+	}
+	return fmt.Sprintf("Version(%d)", int(v))
+}
+
+// Response is the scripted response of an endpoint.
+type Response struct {
+	// StatusCode is the HTTP status code. Default: 200
+	StatusCode int
+	// Body is the raw response body.
+	Body string
+	// Delay is the time to wait before responding.
+	Delay time.Duration
+}
+
+// Server is a fake of the EMQX management API. The endpoints respond with the fixtures of the version
+// by default, and can be scripted by SetResponse and the helpers for error injection.
+// Unknown paths respond with 404, and requests without the APIKey and APISecret respond with 401.
+type Server struct {
+	*httptest.Server
+	version Version
+
+	mtx       sync.Mutex
+	responses map[string]Response
+	requests  map[string]int
+	headers   map[string]http.Header
+}
+
+// NewServer starts a fake server of the version, it should be closed by Close.
+func NewServer(version Version) *Server {
+	s := &Server{
+		version:  version,
+		requests: make(map[string]int),
+		headers:  make(map[string]http.Header),
+	}
+	s.Reset()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewTLSServer starts a fake server of the version over TLS, it should be closed by Close.
+func NewTLSServer(version Version) *Server {
+	s := &Server{
+		version:  version,
+		requests: make(map[string]int),
+		headers:  make(map[string]http.Header),
+	}
+	s.Reset()
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Target returns the address of the server, i.e. `host:port`.
+func (s *Server) Target() string {
+	return s.Listener.Addr().String()
+}
+
+// Metrics returns the metrics config to scrape the server, which trusts the certificate of the server over TLS.
+func (s *Server) Metrics() *config.Metrics {
+	metrics := &config.Metrics{
+		Name:      s.Target(),
+		Target:    s.Target(),
+		Scheme:    "http",
+		APIKey:    APIKey,
+		APISecret: APISecret,
+	}
+	if s.TLS != nil {
+		metrics.Scheme = "https"
+		metrics.TLSClientConfig = &config.TLSClientConfig{
+			CAData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}),
+		}
+	}
+	return metrics
+}
+
+// Reset restores the fixtures of the version and clears the request counts.
+func (s *Server) Reset() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	fixtures := v5Fixtures
+	if s.version == V4 {
+		fixtures = v4Fixtures
+	}
+	s.responses = make(map[string]Response, len(fixtures))
+	for path, body := range fixtures {
+		s.responses[path] = Response{StatusCode: http.StatusOK, Body: body}
+	}
+	s.requests = make(map[string]int)
+}
+
+// SetResponse scripts the response of the path.
+func (s *Server) SetResponse(path string, resp Response) {
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.responses[path] = resp
+}
+
+// SetJSON scripts the path to respond with the JSON body.
+func (s *Server) SetJSON(path, body string) {
+	s.SetResponse(path, Response{Body: body})
+}
+
+// SetStatusError scripts the path to respond with the HTTP status code, e.g. 500.
+func (s *Server) SetStatusError(path string, statusCode int) {
+	s.SetResponse(path, Response{StatusCode: statusCode, Body: fmt.Sprintf(`{"message": %q}`, http.StatusText(statusCode))})
+}
+
+// SetCodeError scripts the path to respond with the `code` field of an error, the code is an integer
+// for EMQX 4.4 and a string for EMQX 5, e.g. 102 or "NOT_FOUND".
+func (s *Server) SetCodeError(path string, code interface{}, message string) {
+	var body string
+	switch code := code.(type) {
+	case string:
+		body = fmt.Sprintf(`{"code": %q, "message": %q}`, code, message)
+	default:
+		body = fmt.Sprintf(`{"code": %v, "message": %q}`, code, message)
+	}
+	s.SetJSON(path, body)
+}
+
+// SetInvalidJSON scripts the path to respond with a body which isn't valid JSON.
+func (s *Server) SetInvalidJSON(path string) {
+	s.SetJSON(path, `{"data": [`)
+}
+
+// SetDelay scripts the path to respond after the delay, keeping its body.
+func (s *Server) SetDelay(path string, delay time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	resp := s.responses[path]
+	resp.Delay = delay
+	s.responses[path] = resp
+}
+
+// Remove scripts the path to respond with 404.
+func (s *Server) Remove(path string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.responses, path)
+}
+
+// Requests returns how many times the path has been requested.
+func (s *Server) Requests(path string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests[path]
+}
+
+// Header returns the headers of the last request of the path.
+func (s *Server) Header(path string) http.Header {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.headers[path].Clone()
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	s.requests[r.URL.Path]++
+	s.headers[r.URL.Path] = r.Header.Clone()
+	resp, ok := s.responses[r.URL.Path]
+	s.mtx.Unlock()
+
+	if key, secret, _ := r.BasicAuth(); key != APIKey || secret != APISecret {
+		http.Error(w, `{"code": "BAD_API_KEY_OR_SECRET", "message": "Check api_key/api_secret"}`, http.StatusUnauthorized)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"code": "NOT_FOUND", "message": "Request Path Not Found"}`, http.StatusNotFound)
+		return
+	}
+
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write([]byte(resp.Body))
+}
@@ -3,74 +3,347 @@ package collector
 import (
 	"emqx-exporter/config"
 
+	"context"
+	"fmt"
 	stdlog "log"
 	"net/http"
+	"reflect"
 	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
-	promcollectors "github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
 )
 
-func NewHandler(disableExporterMetrics bool, maxRequests int, metrics *config.Metrics, logger log.Logger) http.Handler {
+// Handler serves the metrics of the only configured cluster when no target is given,
+// and the metrics of the named cluster, labelled by `cluster`, for `/metrics?target=<name>`.
+// The collectors can be filtered per scrape by `collect[]` parameters, e.g. `/metrics?collect[]=cluster`.
+type Handler struct {
+	includeExporterMetrics bool
+	// inFlight limits the concurrent scrapes of all the handlers, it's nil if there is no limit.
+	inFlight      chan struct{}
+	timeoutOffset time.Duration
+	probes        prometheus.Gatherer
+	logger        log.Logger
+
+	mtx               sync.RWMutex
+	unfilteredHandler http.Handler
+	clusters          map[string]*config.Metrics
+	collectors        map[string]*emqxCluster
+	targetHandlers    map[string]http.Handler
+}
+
+// emqxCluster is the client and the collector of a cluster with the cancel func of the client.
+type emqxCluster struct {
+	metrics   *config.Metrics
+	client    *client
+	collector *EMQXCollector
+	// apiRegistry is the registry of the metrics of the requests to the API by the client.
+	apiRegistry *prometheus.Registry
+	cancel      context.CancelFunc
+	logger      log.Logger
+}
+
+// NewHandler creates a Handler. The metrics about the exporter itself are gathered from
+// the default registry, which includes the process and Go collectors and the config reload metrics.
+// The scrapes are limited by the scrape timeout of Prometheus minus the timeoutOffset.
+// The metrics of the requests to the API of EMQX are served by every scrape of the cluster.
+// The metrics of the background probes are gathered from probes, they're served without a target
+// regardless of disableExporterMetrics, as they're not about the exporter itself.
+func NewHandler(probes prometheus.Gatherer, disableExporterMetrics bool, maxRequests int, timeoutOffset time.Duration, metrics config.MetricsList, logger log.Logger) *Handler {
+	h := &Handler{
+		probes:                 probes,
+		includeExporterMetrics: !disableExporterMetrics,
+		timeoutOffset:          timeoutOffset,
+		logger:                 logger,
+		collectors:             make(map[string]*emqxCluster, len(metrics)),
+	}
+	if h.includeExporterMetrics {
+		level.Info(logger).Log("msg", "Including metrics about the exporter itself")
+	} else {
+		level.Info(logger).Log("msg", "Excluding metrics about the exporter itself")
+	}
+	if maxRequests > 0 {
+		h.inFlight = make(chan struct{}, maxRequests)
+	}
+
+	if err := h.Reload(metrics); err != nil {
+		level.Debug(logger).Log("msg", "Couldn't create collector", "err", err)
+		panic("Couldn't create collector")
+	}
+	return h
+}
+
+// Reload applies the metrics config. The clients of the clusters whose config has changed or
+// which have been removed are stopped, the others are kept as they are. If the config fails to
+// apply, the clients created for it are stopped and the handler is left as it was.
+func (h *Handler) Reload(metrics config.MetricsList) error {
+	clusters := make(map[string]*config.Metrics, len(metrics))
+	for _, m := range metrics {
+		clusters[m.Name] = m
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	previous := h.collectors
+	h.collectors = make(map[string]*emqxCluster, len(clusters))
+	for name, c := range previous {
+		if m, ok := clusters[name]; ok && reflect.DeepEqual(m, c.metrics) {
+			h.collectors[name] = c
+		}
+	}
+
+	var defaultCluster *config.Metrics
+	switch len(metrics) {
+	case 0:
+		level.Info(h.logger).Log("msg", "No metrics configured, skipping cluster metrics")
+	case 1:
+		defaultCluster = metrics[0]
+	default:
+		level.Info(h.logger).Log("msg", "Multiple clusters configured, use /metrics?target=<name> to scrape them", "clusters", len(metrics))
+	}
+
+	unfilteredHandler, err := h.innerHandlerLocked(defaultCluster, nil, nil)
+	if err != nil {
+		for name, c := range h.collectors {
+			if previous[name] != c {
+				c.cancel()
+			}
+		}
+		h.collectors = previous
+		return err
+	}
+
+	for name, c := range previous {
+		if h.collectors[name] == c {
+			continue
+		}
+		level.Info(h.logger).Log("msg", "Stopping the collector of cluster", "cluster", name)
+		c.cancel()
+	}
+	h.unfilteredHandler = unfilteredHandler
+	h.clusters = clusters
+	h.targetHandlers = make(map[string]http.Handler, len(clusters))
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	filters := r.URL.Query()["collect[]"]
+	level.Debug(h.logger).Log("msg", "collect query:", "target", target, "filters", fmt.Sprintf("%v", filters))
+
+	if target == "" && len(filters) == 0 {
+		h.mtx.RLock()
+		unfilteredHandler := h.unfilteredHandler
+		h.mtx.RUnlock()
+		unfilteredHandler.ServeHTTP(w, r)
+		return
+	}
+
+	handler, err := h.filteredHandler(target, filters)
+	if err != nil {
+		level.Warn(h.logger).Log("msg", "Couldn't create filtered metrics handler:", "err", err)
+		http.Error(w, fmt.Sprintf("Couldn't create filtered metrics handler: %s", err), http.StatusBadRequest)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// filteredHandler returns the handler of the named cluster, or of the default cluster if no target is given,
+// with the filtered collectors. The handler of a target without filters is cached.
+func (h *Handler) filteredHandler(target string, filters []string) (http.Handler, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if target == "" {
+		return h.innerHandlerLocked(h.defaultClusterLocked(), nil, filters)
+	}
+
+	if th, ok := h.targetHandlers[target]; ok && len(filters) == 0 {
+		return th, nil
+	}
+	cluster, ok := h.clusters[target]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster target %q", target)
+	}
+	th, err := h.innerHandlerLocked(cluster, prometheus.Labels{"cluster": cluster.Name}, filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(filters) == 0 {
+		h.targetHandlers[target] = th
+	}
+	return th, nil
+}
+
+func (h *Handler) defaultClusterLocked() *config.Metrics {
+	if len(h.clusters) != 1 {
+		return nil
+	}
+	for _, cluster := range h.clusters {
+		return cluster
+	}
+	return nil
+}
+
+func (h *Handler) innerHandlerLocked(cluster *config.Metrics, labels prometheus.Labels, filters []string) (http.Handler, error) {
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(version.NewCollector("emqx_exporter"))
+	gatherers := prometheus.Gatherers{registry}
+	// The metrics of the background probes are not exposed by the handlers of targets like the exporter metrics.
+	if h.probes != nil && labels == nil {
+		gatherers = append(gatherers, h.probes)
+	}
+	sh := &scrapeHandler{
+		labels: labels,
+		opts: promhttp.HandlerOpts{
+			ErrorLog:      stdlog.New(log.NewStdlibAdapter(level.Error(h.logger)), "", 0),
+			ErrorHandling: promhttp.ContinueOnError,
+		},
+		timeoutOffset: h.timeoutOffset,
+		inFlight:      h.inFlight,
+	}
 
-	if metrics == nil {
-		level.Info(logger).Log("msg", "No metrics configured, skipping cluster metrics")
-	} else {
-		emqxCluster := newClient(metrics, logger)
-		nc, err := NewEMQXCollector(emqxCluster, logger)
+	if cluster != nil {
+		c, err := h.emqxClusterLocked(cluster)
 		if err != nil {
-			level.Debug(logger).Log("msg", "Couldn't create collector", "err", err)
-			panic("Couldn't create collector")
+			return nil, err
 		}
+		nc := c.collector
+		if len(filters) > 0 {
+			collectors, err := filterCollectors(enabledCollectors(cluster.Collectors), filters)
+			if err != nil {
+				return nil, err
+			}
+			if nc, err = c.collector.filter(collectors); err != nil {
+				return nil, err
+			}
+		}
+		// The collector is registered for every scrape within its timeout, so it's checked here once.
+		if err := prometheus.WrapRegistererWith(labels, prometheus.NewRegistry()).Register(nc); err != nil {
+			return nil, fmt.Errorf("couldn't register emqx collector: %s", err)
+		}
+		sh.collector = nc
+		gatherers = append(gatherers, c.apiRegistry)
+	}
+	sh.gatherer = gatherers
+
+	// The exporter metrics are not exposed by the handlers of targets,
+	// so that scraping several clusters doesn't duplicate them.
+	if !h.includeExporterMetrics || labels != nil {
+		return sh, nil
+	}
 
-		level.Info(logger).Log("msg", "Enabled collectors")
-		collectors := make([]string, 0, len(nc.Collectors))
-		for n := range nc.Collectors {
-			collectors = append(collectors, n)
+	sh.opts.Registry = prometheus.DefaultRegisterer
+	sh.gatherer = append(prometheus.Gatherers{prometheus.DefaultGatherer}, gatherers...)
+	return promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, sh,
+	), nil
+}
+
+// scrapeHandler serves the metrics of the gatherer and the collector of a cluster. The collector is
+// limited by the scrape timeout of Prometheus minus the offset, given by X-Prometheus-Scrape-Timeout-Seconds.
+type scrapeHandler struct {
+	gatherer      prometheus.Gatherer
+	collector     *EMQXCollector
+	labels        prometheus.Labels
+	opts          promhttp.HandlerOpts
+	timeoutOffset time.Duration
+	// inFlight is shared by all the handlers, it's nil if there is no limit.
+	inFlight chan struct{}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *scrapeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.inFlight != nil {
+		select {
+		case h.inFlight <- struct{}{}:
+			defer func() { <-h.inFlight }()
+		default:
+			http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", cap(h.inFlight)), http.StatusServiceUnavailable)
+			return
 		}
-		sort.Strings(collectors)
-		for _, c := range collectors {
-			level.Info(logger).Log("collector", c)
+	}
+
+	ctx, cancel, err := ScrapeContext(r, h.timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	gatherers := prometheus.Gatherers{h.gatherer}
+	if h.collector != nil {
+		registry := prometheus.NewRegistry()
+		if err := prometheus.WrapRegistererWith(h.labels, registry).Register(h.collector.WithContext(ctx)); err != nil {
+			http.Error(w, fmt.Sprintf("Couldn't register emqx collector: %s", err), http.StatusInternalServerError)
+			return
 		}
-		registry.MustRegister(nc)
+		gatherers = append(gatherers, registry)
 	}
+	promhttp.HandlerFor(gatherers, h.opts).ServeHTTP(w, r)
+}
 
-	var h http.Handler
-	if disableExporterMetrics {
-		level.Info(logger).Log("msg", "Excluding metrics about the exporter itself")
-		h = promhttp.HandlerFor(
-			registry,
-			promhttp.HandlerOpts{
-				ErrorLog:            stdlog.New(log.NewStdlibAdapter(level.Error(logger)), "", 0),
-				ErrorHandling:       promhttp.ContinueOnError,
-				MaxRequestsInFlight: maxRequests,
-			})
-	} else {
-		level.Info(logger).Log("msg", "Including metrics about the exporter itself")
-		exporterMetricsRegistry := prometheus.NewRegistry()
-		exporterMetricsRegistry.MustRegister(
-			promcollectors.NewProcessCollector(promcollectors.ProcessCollectorOpts{}),
-			promcollectors.NewGoCollector(),
-		)
-
-		h = promhttp.HandlerFor(
-			prometheus.Gatherers{exporterMetricsRegistry, registry},
-			promhttp.HandlerOpts{
-				ErrorLog:            stdlog.New(log.NewStdlibAdapter(level.Error(logger)), "", 0),
-				ErrorHandling:       promhttp.ContinueOnError,
-				MaxRequestsInFlight: maxRequests,
-				Registry:            exporterMetricsRegistry,
-			})
-		h = promhttp.InstrumentMetricHandler(
-			exporterMetricsRegistry, h,
-		)
+// ScrapeContext returns the context of the scrape, whose deadline is the scrape timeout of Prometheus minus the
+// offset, or the timeout itself if it's not longer than the offset. There is no deadline without the timeout.
+func ScrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc, error) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return nil, nil, fmt.Errorf("failed to parse timeout from Prometheus header: %q", v)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// emqxClusterLocked returns the client and the collector of the cluster, so that all handlers
+// of the same cluster share one client.
+func (h *Handler) emqxClusterLocked(cluster *config.Metrics) (*emqxCluster, error) {
+	if c, ok := h.collectors[cluster.Name]; ok {
+		return c, nil
 	}
 
-	return h
+	logger := log.With(h.logger, "cluster", cluster.Name)
+	ctx, cancel := context.WithCancel(context.Background())
+	apiRegistry := prometheus.NewRegistry()
+	client := newClient(ctx, cluster, newAPIMetrics(apiRegistry), logger)
+	nc, err := NewEMQXCollector(client, logger, enabledCollectors(cluster.Collectors)...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if cluster.Cache != nil {
+		level.Info(logger).Log("msg", "Refreshing the collectors in the background", "interval", cluster.Cache.Interval)
+		nc.startCache(ctx, client, cluster.Cache)
+	}
+
+	level.Info(logger).Log("msg", "Enabled collectors")
+	collectors := make([]string, 0, len(nc.Collectors))
+	for n := range nc.Collectors {
+		collectors = append(collectors, n)
+	}
+	sort.Strings(collectors)
+	for _, c := range collectors {
+		level.Info(logger).Log("collector", c)
+	}
+
+	c := &emqxCluster{metrics: cluster, client: client, collector: nc, apiRegistry: apiRegistry, cancel: cancel, logger: logger}
+	h.collectors[cluster.Name] = c
+	return c, nil
 }
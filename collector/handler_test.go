@@ -0,0 +1,295 @@
+package collector
+
+import (
+	"emqx-exporter/collector/emqxtest"
+	"emqx-exporter/config"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerReload(t *testing.T) {
+	clusterA := &config.Metrics{Name: "cluster-a", Target: "127.0.0.1:1", APIKey: "key", APISecret: "secret", Scheme: "http"}
+	clusterB := &config.Metrics{Name: "cluster-b", Target: "127.0.0.1:2", APIKey: "key", APISecret: "secret", Scheme: "http"}
+
+	h := NewHandler(nil, true, 0, 0, config.MetricsList{clusterA, clusterB}, log.NewNopLogger())
+	defer func() { _ = h.Reload(nil) }()
+
+	statusOf := func(target string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics?target="+target, nil))
+		return rec.Code
+	}
+
+	for _, target := range []string{"cluster-a", "cluster-b"} {
+		if code := statusOf(target); code != http.StatusOK {
+			t.Fatalf("Expected status 200 for target %s but got %d", target, code)
+		}
+	}
+	collectorA := h.collectors["cluster-a"]
+
+	clusterB2 := *clusterB
+	clusterB2.APISecret = "new_secret"
+	if err := h.Reload(config.MetricsList{clusterA, &clusterB2}); err != nil {
+		t.Fatal(err)
+	}
+	if h.collectors["cluster-a"] != collectorA {
+		t.Error("Expected the collector of the unchanged cluster to be kept")
+	}
+	if _, ok := h.collectors["cluster-b"]; ok {
+		t.Error("Expected the collector of the changed cluster to be removed")
+	}
+	if code := statusOf("cluster-b"); code != http.StatusOK {
+		t.Errorf("Expected status 200 for target cluster-b but got %d", code)
+	}
+	if h.collectors["cluster-b"].metrics.APISecret != "new_secret" {
+		t.Error("Expected the collector of the changed cluster to use the new config")
+	}
+
+	if err := h.Reload(config.MetricsList{clusterA}); err != nil {
+		t.Fatal(err)
+	}
+	if code := statusOf("cluster-b"); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for removed target cluster-b but got %d", code)
+	}
+
+	// The config which fails to apply leaves the handler as it was.
+	cancelA, cancelled := collectorA.cancel, false
+	collectorA.cancel = func() { cancelled = true; cancelA() }
+	invalidA := *clusterA
+	invalidA.Collectors = []string{"unknown"}
+	if err := h.Reload(config.MetricsList{&invalidA}); err == nil {
+		t.Fatal("Expected an error for the unknown collector")
+	}
+	if h.collectors["cluster-a"] != collectorA || h.clusters["cluster-a"] != clusterA {
+		t.Error("Expected the collector of the cluster to be kept after the failed reload")
+	}
+	if cancelled {
+		t.Error("Expected the client of the cluster to keep running after the failed reload")
+	}
+	if code := statusOf("cluster-a"); code != http.StatusOK {
+		t.Errorf("Expected status 200 for target cluster-a after the failed reload but got %d", code)
+	}
+}
+
+func TestHandlerProbeMetrics(t *testing.T) {
+	cluster := &config.Metrics{Name: "cluster-a", Target: "127.0.0.1:1", APIKey: "key", APISecret: "secret", Scheme: "http"}
+	probes := prometheus.NewRegistry()
+	success := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "emqx_mqtt_probe_success_total"}, []string{"target", "module"})
+	success.WithLabelValues("127.0.0.1:1883", "pubsub").Inc()
+	probes.MustRegister(success)
+
+	h := NewHandler(probes, true, 0, 0, config.MetricsList{cluster}, log.NewNopLogger())
+	defer func() { _ = h.Reload(nil) }()
+
+	for _, tc := range []struct {
+		query    string
+		expected bool
+	}{
+		{query: "", expected: true},
+		{query: "?collect[]=cluster", expected: true},
+		{query: "?target=cluster-a", expected: false},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics"+tc.query, nil))
+		if got := strings.Contains(rec.Body.String(), `emqx_mqtt_probe_success_total{module="pubsub",target="127.0.0.1:1883"} 1`); got != tc.expected {
+			t.Errorf("Expected the probe metrics on /metrics%s %v, got:\n%s", tc.query, tc.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestHandlerAPIMetrics(t *testing.T) {
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	clusterA := server.Metrics()
+	clusterA.Name = "cluster-a"
+	clusterB := &config.Metrics{Name: "cluster-b", Target: "127.0.0.1:1", APIKey: "key", APISecret: "secret", Scheme: "http"}
+
+	h := NewHandler(nil, true, 0, 0, config.MetricsList{clusterA, clusterB}, log.NewNopLogger())
+	defer func() { _ = h.Reload(nil) }()
+
+	// The metrics of the requests are served by the scrapes of the cluster even without the exporter metrics.
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics?target=cluster-a&collect[]=cluster", nil))
+		if body = rec.Body.String(); strings.Contains(body, `emqx_exporter_api_requests_total{cluster="cluster-a",endpoint="/api/v5/nodes",status_code="200"}`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(body, `emqx_exporter_api_requests_total{cluster="cluster-a",endpoint="/api/v5/nodes",status_code="200"}`) {
+		t.Fatalf("Expected the requests of cluster-a on its scrape, got:\n%s", body)
+	}
+	if !strings.Contains(body, `emqx_exporter_api_request_duration_seconds_count{cluster="cluster-a"`) {
+		t.Errorf("Expected the durations of the requests of cluster-a on its scrape, got:\n%s", body)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics?target=cluster-b", nil))
+	if body := rec.Body.String(); strings.Contains(body, `cluster="cluster-a"`) {
+		t.Errorf("Expected the requests of cluster-a not to be served by the scrape of cluster-b, got:\n%s", body)
+	}
+}
+
+func TestHandlerFilterCollectors(t *testing.T) {
+	cluster := &config.Metrics{Name: "cluster-a", Target: "127.0.0.1:1", APIKey: "key", APISecret: "secret", Scheme: "http",
+		Collectors: []string{"cluster", "license"}}
+
+	h := NewHandler(nil, true, 0, 0, config.MetricsList{cluster}, log.NewNopLogger())
+	defer func() { _ = h.Reload(nil) }()
+
+	testcases := []struct {
+		query    string
+		code     int
+		expected []string
+		excluded []string
+	}{
+		{
+			query:    "",
+			code:     http.StatusOK,
+			expected: []string{`collector="cluster"`, `collector="license"`},
+			excluded: []string{`collector="rule"`},
+		},
+		{
+			query:    "?collect[]=cluster",
+			code:     http.StatusOK,
+			expected: []string{`collector="cluster"`},
+			excluded: []string{`collector="license"`},
+		},
+		{
+			query:    "?target=cluster-a&collect[]=license",
+			code:     http.StatusOK,
+			expected: []string{`cluster="cluster-a",collector="license"`},
+			excluded: []string{`collector="cluster"`},
+		},
+		{
+			query: "?collect[]=rule",
+			code:  http.StatusBadRequest,
+		},
+		{
+			query: "?collect[]=unknown",
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected status %d but got %d", tc.query, tc.code, rec.Code)
+			continue
+		}
+		body := rec.Body.String()
+		for _, s := range tc.expected {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: expected %s in the metrics", tc.query, s)
+			}
+		}
+		for _, s := range tc.excluded {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: expected no %s in the metrics", tc.query, s)
+			}
+		}
+	}
+}
+
+func TestHandlerScrapeTimeout(t *testing.T) {
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	cluster := server.Metrics()
+	cluster.Collectors = []string{"cluster", "messages"}
+
+	h := NewHandler(nil, true, 0, 100*time.Millisecond, config.MetricsList{cluster}, log.NewNopLogger())
+	defer func() { _ = h.Reload(nil) }()
+	deadline := time.Now().Add(10 * time.Second)
+	for h.collectors[cluster.Name].client.current() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Couldn't detect the version of the fake server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	delay := 2 * time.Second
+	server.SetDelay("/api/v5/monitor_current", delay)
+
+	testcases := []struct {
+		timeout  string
+		code     int
+		expected []string
+	}{
+		{
+			timeout: "0.5",
+			code:    http.StatusOK,
+			expected: []string{
+				`emqx_scrape_collector_success{collector="cluster"} 1`,
+				`emqx_scrape_collector_timeout{collector="messages"} 1`,
+			},
+		},
+		{
+			timeout: "invalid",
+			code:    http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.timeout)
+		rec := httptest.NewRecorder()
+		begin := time.Now()
+		h.ServeHTTP(rec, req)
+		if elapsed := time.Since(begin); elapsed >= delay {
+			t.Errorf("%s: expected the scrape to end by the timeout, but it took %s", tc.timeout, elapsed)
+		}
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected status %d but got %d", tc.timeout, tc.code, rec.Code)
+			continue
+		}
+		for _, s := range tc.expected {
+			if !strings.Contains(rec.Body.String(), s) {
+				t.Errorf("%s: expected %s in the metrics, got:\n%s", tc.timeout, s, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestHandlerMaxRequests(t *testing.T) {
+	server := emqxtest.NewServer(emqxtest.V5)
+	defer server.Close()
+	cluster := server.Metrics()
+	cluster.Name = "cluster-a"
+
+	h := NewHandler(nil, true, 1, 0, config.MetricsList{cluster}, log.NewNopLogger())
+	defer func() { _ = h.Reload(nil) }()
+	deadline := time.Now().Add(10 * time.Second)
+	for h.collectors[cluster.Name].client.current() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Couldn't detect the version of the fake server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.SetDelay("/api/v5/monitor_current", time.Second)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// The limit is shared by the handlers of targets and of filters.
+	for _, query := range []string{"", "?collect[]=cluster", "?target=cluster-a"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics"+query, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503 for /metrics%s while a scrape is in flight but got %d", query, rec.Code)
+		}
+	}
+	<-done
+}
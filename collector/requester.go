@@ -1,55 +1,195 @@
 package collector
 
 import (
+	"context"
 	"emqx-exporter/config"
+	"emqx-exporter/tlsinfo"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpproxy"
 )
 
 type requester struct {
 	client *fasthttp.Client
 	uri    *fasthttp.URI
+	// cluster is the name of the cluster, which labels the metrics of the requests.
+	cluster string
+	metrics *apiMetrics
+	// sem limits the requests in flight to EMQX, shared by all the collectors of the cluster.
+	sem          chan struct{}
+	headers      map[string]string
+	retries      int
+	retryBackoff time.Duration
 }
 
-func newRequester(metrics *config.Metrics) *requester {
+func newRequester(metrics *config.Metrics, tlsState *tlsinfo.State, apiMetrics *apiMetrics) *requester {
+	serverName, _, err := net.SplitHostPort(metrics.Target)
+	if err != nil {
+		serverName = metrics.Target
+	}
+
+	// The config may not be loaded by ReloadConfig, e.g. in tests.
+	maxConcurrency := metrics.MaxConcurrentRequests
+	if maxConcurrency <= 0 {
+		maxConcurrency = config.DefaultMaxConcurrentRequests
+	}
+	httpConfig := metrics.HTTP
+	if httpConfig == nil {
+		httpConfig = config.DefaultHTTPClientConfig(maxConcurrency)
+	}
+
 	uri := &fasthttp.URI{}
 	uri.SetUsername(metrics.APIKey)
-	uri.SetPassword(metrics.APISecret)
+	uri.SetPassword(string(metrics.APISecret))
 	uri.SetScheme(metrics.Scheme)
 	uri.SetHost(metrics.Target)
 
+	headers := make(map[string]string, len(httpConfig.Headers))
+	for name, value := range httpConfig.Headers {
+		headers[name] = string(value)
+	}
+
 	return &requester{
-		uri: uri,
+		uri:          uri,
+		cluster:      metrics.Name,
+		metrics:      apiMetrics,
+		sem:          make(chan struct{}, maxConcurrency),
+		headers:      headers,
+		retries:      httpConfig.Retries,
+		retryBackoff: time.Duration(httpConfig.RetryBackoff * float64(time.Second)),
 		client: &fasthttp.Client{
-			Name:                "EMQX-Exporter", //User-Agent
-			MaxConnsPerHost:     5,
-			MaxIdleConnDuration: 30 * time.Second,
-			ReadTimeout:         5 * time.Second,
-			WriteTimeout:        5 * time.Second,
-			MaxConnWaitTimeout:  5 * time.Second,
-			TLSConfig:           metrics.TLSClientConfig.ToTLSConfig(),
+			Name:                httpConfig.UserAgent,
+			MaxConnsPerHost:     httpConfig.MaxConns,
+			MaxIdleConnDuration: time.Duration(httpConfig.IdleConnTimeout) * time.Second,
+			ReadTimeout:         time.Duration(httpConfig.Timeout) * time.Second,
+			WriteTimeout:        time.Duration(httpConfig.Timeout) * time.Second,
+			MaxConnWaitTimeout:  time.Duration(httpConfig.MaxConnWaitTimeout) * time.Second,
+			TLSConfig:           tlsState.Config(metrics.TLSClientConfig.ToTLSConfig(serverName), serverName),
+			Dial:                proxyDialer(httpConfig.ProxyURL, time.Duration(httpConfig.Timeout)*time.Second),
 			DialDualStack:       true,
+			// The requests are retried by the requester with backoff instead, as every attempt of the client
+			// would restart the timeout, running over the deadline of the scrape.
+			RetryIf: func(*fasthttp.Request) bool { return false },
 		},
 	}
 }
 
-func (r *requester) callHTTPGet(requestURI string) (data []byte, statusCode int, err error) {
+// apiPath is the path of a request and the endpoint it belongs to, e.g. `/api/v5/rules/:id/metrics`,
+// which labels the metrics of the requests instead of the path, so that their cardinality is bounded.
+type apiPath struct {
+	endpoint string
+	path     string
+}
+
+// endpoint returns the path of the endpoint whose parameters, the segments starting with `:`, are replaced
+// by the params in order, e.g. endpoint("/api/v5/rules/:id/metrics", "rule_1").
+func endpoint(template string, params ...string) apiPath {
+	segments := strings.Split(template, "/")
+	for i, segment := range segments {
+		if len(params) > 0 && strings.HasPrefix(segment, ":") {
+			segments[i], params = params[0], params[1:]
+		}
+	}
+	return apiPath{endpoint: template, path: strings.Join(segments, "/")}
+}
+
+// apiMetrics are the metrics of the requests to the API of EMQX by the cluster and the endpoint.
+type apiMetrics struct {
+	duration *prometheus.HistogramVec
+	requests *prometheus.CounterVec
+}
+
+// newAPIMetrics creates the metrics of the requests to the API, registered by reg unless it's nil.
+func newAPIMetrics(reg prometheus.Registerer) *apiMetrics {
+	m := &apiMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "emqx_exporter",
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Histogram of the duration of the requests to the API of EMQX, including the failed ones",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"cluster", "endpoint"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "emqx_exporter",
+			Subsystem: "api",
+			Name:      "requests_total",
+			Help:      "Total number of the requests to the API of EMQX by the status code of the response, or error if there is none",
+		}, []string{"cluster", "endpoint", "status_code"}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.duration, m.requests)
+	}
+	return m
+}
+
+func (m *apiMetrics) observe(cluster, endpoint, statusCode string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.duration.WithLabelValues(cluster, endpoint).Observe(duration.Seconds())
+	m.requests.WithLabelValues(cluster, endpoint, statusCode).Inc()
+}
+
+// proxyDialer returns the dialer through the proxy which connects within the timeout, or nil to dial directly
+// if there is no proxy.
+func proxyDialer(proxy config.SecretURL, timeout time.Duration) fasthttp.DialFunc {
+	if proxy == "" {
+		return nil
+	}
+	// The proxy URL has been validated by the config.
+	proxyURL, _ := url.Parse(string(proxy))
+	if proxyURL.Scheme == "socks5" {
+		return fasthttpproxy.FasthttpSocksDialer(string(proxy))
+	}
+	// The dialer takes the credentials before the last `@` as they are, so they're decoded from the URL.
+	addr := proxyURL.Host
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		addr = proxyURL.User.Username() + ":" + password + "@" + addr
+	}
+	return fasthttpproxy.FasthttpHTTPDialerTimeout(addr, timeout)
+}
+
+// callHTTPGet requests the uri of EMQX, the request is abandoned once ctx is done, and it fails by the deadline of ctx
+// if any, with an error wrapping context.DeadlineExceeded. The request which fails by a connection error or a 5xx
+// response is retried with backoff.
+func (r *requester) callHTTPGet(ctx context.Context, p apiPath) (data []byte, statusCode int, err error) {
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
 
 	req.SetURI(r.uri)
-	req.URI().SetPath(requestURI)
+	req.URI().SetPath(p.path)
 	req.Header.SetMethod(http.MethodGet)
+	for name, value := range r.headers {
+		req.Header.Set(name, value)
+	}
 
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
-	err = r.client.Do(req, resp)
+	backoff := r.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = r.do(ctx, p.endpoint, req, resp)
+		retryable := resp.StatusCode() >= http.StatusInternalServerError
+		if err != nil {
+			retryable = !errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+		}
+		if !retryable || attempt >= r.retries || !sleep(ctx, backoff) {
+			break
+		}
+		backoff *= 2
+		resp.Reset()
+	}
 	if err != nil {
 		err = fmt.Errorf("request %s failed. %w", req.URI().String(), err)
 		return
@@ -62,7 +202,8 @@ func (r *requester) callHTTPGet(requestURI string) (data []byte, statusCode int,
 		return
 	}
 
-	data = resp.Body()
+	// The body is copied, as the response is released to the pool for the other requests.
+	data = append([]byte(nil), resp.Body()...)
 	if len(data) == 0 {
 		err = fmt.Errorf("get nothing from api %s", req.URI().String())
 		return
@@ -96,15 +237,56 @@ func (r *requester) callHTTPGet(requestURI string) (data []byte, statusCode int,
 	return
 }
 
-func (r *requester) callHTTPGetWithResp(requestURI string, respData interface{}) (err error) {
-	data, _, err := r.callHTTPGet(requestURI)
+// do sends the request of the endpoint within ctx, holding a slot of the requests in flight.
+func (r *requester) do(ctx context.Context, endpoint string, req *fasthttp.Request, resp *fasthttp.Response) (err error) {
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-r.sem }()
+
+	begin := time.Now()
+	defer func() {
+		statusCode := "error"
+		if err == nil {
+			statusCode = strconv.Itoa(resp.StatusCode())
+		}
+		r.metrics.observe(r.cluster, endpoint, statusCode, time.Since(begin))
+	}()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return r.client.Do(req, resp)
+	}
+	err = r.client.DoDeadline(req, resp, deadline)
+	if errors.Is(err, fasthttp.ErrTimeout) && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// sleep waits for the duration, it returns false if ctx is done before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (r *requester) callHTTPGetWithResp(ctx context.Context, p apiPath, respData interface{}) (err error) {
+	data, _, err := r.callHTTPGet(ctx, p)
 	if err != nil {
 		return
 	}
 
 	err = jsoniter.Unmarshal(data, respData)
 	if err != nil {
-		err = fmt.Errorf("unmarshal api resp failed: %s, %s", requestURI, err.Error())
+		err = fmt.Errorf("unmarshal api resp failed: %s, %s", p.path, err.Error())
 		return
 	}
 	return
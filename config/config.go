@@ -1,12 +1,16 @@
 package config
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"bytes"
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -15,44 +19,292 @@ import (
 )
 
 type Config struct {
-	Metrics *Metrics `yaml:"metrics,omitempty"`
-	Probes  []Probe  `yaml:"probes,omitempty"`
+	Metrics MetricsList `yaml:"metrics,omitempty"`
+	Probes  []Probe     `yaml:"probes,omitempty"`
+	// Modules are the named probes without targets, which probe the targets given by `/probe?module=<name>&target=<target>`,
+	// e.g. the targets discovered by Prometheus. The names of the modules of Probe are reserved.
+	Modules map[string]Probe `yaml:"modules,omitempty"`
+}
+
+// MetricsList is the list of EMQX clusters to scrape. For backward compatibility,
+// a single mapping is accepted as well as a sequence.
+type MetricsList []*Metrics
+
+func (l *MetricsList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if _, ok := raw.([]interface{}); ok {
+		var list []*Metrics
+		if err := unmarshal(&list); err != nil {
+			return err
+		}
+		*l = list
+		return nil
+	}
+	metrics := &Metrics{}
+	if err := unmarshal(metrics); err != nil {
+		return err
+	}
+	*l = MetricsList{metrics}
+	return nil
 }
 
 type Metrics struct {
+	// Name is the name of the cluster, it's used as the `target` parameter of `/metrics`
+	// and as the value of the `cluster` label.
+	// Default: the value of target
+	Name            string           `yaml:"name,omitempty"`
 	APIKey          string           `yaml:"api_key"`
-	APISecret       string           `yaml:"api_secret"`
+	APISecret       Secret           `yaml:"api_secret,omitempty"`
+	APISecretFile   string           `yaml:"api_secret_file,omitempty"`
 	Target          string           `yaml:"target"`
 	Scheme          string           `yaml:"scheme,omitempty"`
 	TLSClientConfig *TLSClientConfig `yaml:"tls_config,omitempty"`
+	// Collectors is the list of collectors enabled for the cluster, it overrides the --collector.<name> flags.
+	// Enum: [cluster | license | messages | rule | authentication | authorization | tls]
+	// Default: the collectors enabled by flags
+	Collectors []string `yaml:"collectors,omitempty"`
+	// MaxConcurrentRequests is the maximum number of the requests in flight to the API of EMQX,
+	// shared by the collectors of the cluster which fetch concurrently.
+	// Default: 5
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests,omitempty"`
+	// Cache enables refreshing the collectors in the background, so that `/metrics` serves the snapshots
+	// of the collectors instead of fetching from EMQX at every scrape.
+	Cache *CacheConfig `yaml:"cache,omitempty"`
+	// HTTP is the settings of the HTTP client requesting the API of EMQX.
+	HTTP *HTTPClientConfig `yaml:"http,omitempty"`
 }
 
+// DefaultMaxConcurrentRequests is the default of Metrics.MaxConcurrentRequests.
+const DefaultMaxConcurrentRequests = 5
+
+type CacheConfig struct {
+	// Interval is the interval in seconds of refreshing every collector, a refresh is limited to the interval.
+	Interval int64 `yaml:"interval"`
+	// Intervals overrides the interval in seconds of the collectors by their names, e.g. `rule: 120`.
+	Intervals map[string]int64 `yaml:"intervals,omitempty"`
+	// MaxStaleness is the age in seconds after which the snapshot of a collector isn't served
+	// if it has failed to be refreshed since.
+	// Default: 3 times the interval of the collector
+	MaxStaleness int64 `yaml:"max_staleness,omitempty"`
+}
+
+// HTTPClientConfig is the settings of the HTTP client requesting the API of EMQX.
+type HTTPClientConfig struct {
+	// Timeout is the timeout in seconds of writing a request and reading its response.
+	// Default: 5
+	Timeout int64 `yaml:"timeout,omitempty"`
+	// MaxConnWaitTimeout is the time in seconds to wait for a free connection once max_conns are all busy.
+	// Default: 5
+	MaxConnWaitTimeout int64 `yaml:"max_conn_wait_timeout,omitempty"`
+	// IdleConnTimeout is the time in seconds after which the idle connections are closed.
+	// Default: 30
+	IdleConnTimeout int64 `yaml:"idle_conn_timeout,omitempty"`
+	// MaxConns is the maximum number of the connections to EMQX.
+	// Default: the value of max_concurrent_requests
+	MaxConns int `yaml:"max_conns,omitempty"`
+	// Retries is the number of the retries of a request which fails by a connection error or a 5xx response.
+	Retries int `yaml:"retries,omitempty"`
+	// RetryBackoff is the time in seconds to wait before the first retry, it's doubled for every further retry.
+	// Default: 0.5
+	RetryBackoff float64 `yaml:"retry_backoff,omitempty"`
+	// ProxyURL is the proxy of the requests, `http://` for a proxy by CONNECT or `socks5://`.
+	ProxyURL SecretURL `yaml:"proxy_url,omitempty"`
+	// Headers are the HTTP headers of the requests, e.g. the credentials of a gateway in front of EMQX.
+	Headers map[string]Secret `yaml:"headers,omitempty"`
+	// UserAgent is the User-Agent header of the requests.
+	// Default: EMQX-Exporter
+	UserAgent string `yaml:"user_agent,omitempty"`
+}
+
+// DefaultHTTPClientConfig returns the HTTP client config with the defaults, for the cluster with maxConcurrentRequests.
+func DefaultHTTPClientConfig(maxConcurrentRequests int) *HTTPClientConfig {
+	c := &HTTPClientConfig{}
+	c.setDefaults(maxConcurrentRequests)
+	return c
+}
+
+func (c *HTTPClientConfig) setDefaults(maxConcurrentRequests int) {
+	if c.Timeout == 0 {
+		c.Timeout = 5
+	}
+	if c.MaxConnWaitTimeout == 0 {
+		c.MaxConnWaitTimeout = 5
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = 30
+	}
+	if c.MaxConns == 0 {
+		c.MaxConns = maxConcurrentRequests
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 0.5
+	}
+	if c.UserAgent == "" {
+		c.UserAgent = "EMQX-Exporter"
+	}
+}
+
+func (c *HTTPClientConfig) validate(field string) error {
+	if c.Timeout < 0 || c.MaxConnWaitTimeout < 0 || c.IdleConnTimeout < 0 {
+		return fmt.Errorf("%s: the timeouts must not be negative", field)
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("%s.max_conns must be positive", field)
+	}
+	if c.Retries < 0 || c.RetryBackoff < 0 {
+		return fmt.Errorf("%s.retries and %s.retry_backoff must not be negative", field, field)
+	}
+	if err := validateProxyURL(field, c.ProxyURL); err != nil {
+		return err
+	}
+	for name := range c.Headers {
+		if name == "" {
+			return fmt.Errorf("%s.headers: the header name is empty", field)
+		}
+	}
+	return nil
+}
+
+// IntervalOf returns the interval of refreshing the collector.
+func (c *CacheConfig) IntervalOf(collector string) time.Duration {
+	if interval, ok := c.Intervals[collector]; ok {
+		return time.Duration(interval) * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// MaxStalenessOf returns the max staleness of the snapshot of the collector.
+func (c *CacheConfig) MaxStalenessOf(collector string) time.Duration {
+	if c.MaxStaleness > 0 {
+		return time.Duration(c.MaxStaleness) * time.Second
+	}
+	return 3 * c.IntervalOf(collector)
+}
+
+// The modules of probes.
+const (
+	ProbeModulePubSub   = "pubsub"
+	ProbeModuleRetained = "retained"
+	ProbeModuleWill     = "will"
+	ProbeModuleShared   = "shared"
+	ProbeModuleSession  = "session"
+)
+
+// The rejections expected by probes.
+const (
+	ProbeExpectConnectRefused  = "connect_refused"
+	ProbeExpectSubscribeDenied = "subscribe_denied"
+	ProbeExpectPublishDenied   = "publish_denied"
+)
+
 type Probe struct {
-	// Target is the address of the EMQX node to probe. Required.
+	// Target is the address of the EMQX node to probe. Required, unless PublishTarget and SubscribeTarget are set,
+	// then it's the name of the probe.
+	// Default: <publish_target>-><subscribe_target>
 	Target string `yaml:"target"`
+	// PublishTarget is the address of the EMQX node to publish the probe message to, and SubscribeTarget is
+	// the address of the node to receive it from, so that the routing across the cluster is probed.
+	// Either address can be prefixed with a scheme, e.g. `ws://127.0.0.1:8083`, to probe another listener.
+	// They are both required if either is set.
+	PublishTarget   string `yaml:"publish_target,omitempty"`
+	SubscribeTarget string `yaml:"subscribe_target,omitempty"`
+	// Module is what the probe checks: `pubsub` publishes a message and receives it from the subscription,
+	// `retained` publishes a retained message and receives it by a fresh subscription, and `will` connects with
+	// a will message, drops the connection uncleanly and receives the will from the subscription, `shared`
+	// publishes messages to the subscribers of a shared subscription and checks how they're distributed, and
+	// `session` publishes messages while the subscriber of a persistent session is offline and checks that
+	// they're delivered when it resumes the session.
+	// Enum: [pubsub | retained | will | shared | session]
+	// Default: pubsub
+	Module string `yaml:"module,omitempty"`
+	// SharedGroup is the group of the shared subscription `$share/<group>/<topic>` of the shared module.
+	// Default: emqx-exporter
+	SharedGroup string `yaml:"shared_group,omitempty"`
+	// SharedSubscribers is the number of the subscribers in the shared group of the shared module.
+	// Default: 2
+	SharedSubscribers int `yaml:"shared_subscribers,omitempty"`
+	// SharedMessages is the number of the messages published by the shared module.
+	// Default: 10
+	SharedMessages int `yaml:"shared_messages,omitempty"`
+	// SessionMessages is the number of the messages published while the subscriber of the session module is offline.
+	// Default: 3
+	SessionMessages int `yaml:"session_messages,omitempty"`
+	// ResumeTarget is the address of the EMQX node the subscriber of the session module reconnects to, so that
+	// the takeover of the session by another node is probed. It can be prefixed with a scheme.
+	// Default: the subscribe target
+	ResumeTarget string `yaml:"resume_target,omitempty"`
+	// Expect is the rejection the probe expects, so that it succeeds only when EMQX rejects the credentials or
+	// the ACL of the probe: `connect_refused` by CONNACK, `subscribe_denied` by SUBACK, and `publish_denied`
+	// when the message isn't delivered.
+	// Enum: [connect_refused | subscribe_denied | publish_denied]
+	// Default: the probe succeeds when the message is delivered
+	Expect string `yaml:"expect,omitempty"`
 	// Scheme is the protocol scheme of the EMQX node to probe.
 	// Enum: [mqtt | tcp | mqtts | ssl | tls | ws | wss]
 	// Default: tcp
 	Scheme string `yaml:"scheme,omitempty"`
+	// WSPath is the path of the WebSocket endpoint of `ws` and `wss`, e.g. `/mqtt` of EMQX. The path of a target
+	// prefixed with the scheme takes precedence, e.g. `ws://127.0.0.1:8083/mqtt`.
+	// Default: /
+	WSPath string `yaml:"ws_path,omitempty"`
+	// WSSubprotocol is the subprotocol requested by the WebSocket handshake.
+	// Default: mqtt
+	WSSubprotocol string `yaml:"ws_subprotocol,omitempty"`
+	// WSHeaders are the HTTP headers of the WebSocket handshake, e.g. the credentials of an ingress.
+	WSHeaders map[string]Secret `yaml:"ws_headers,omitempty"`
+	// ProxyURL is the proxy of the WebSocket handshake, `http://` for a proxy by CONNECT or `socks5://`.
+	// Default: the proxy of the `HTTP_PROXY` and `HTTPS_PROXY` environment variables
+	ProxyURL SecretURL `yaml:"proxy_url,omitempty"`
 	// ClientID is the MQTT client ID to use when probing.
-	// Default: emqx_exporter_probe_<index>
+	// Default: emqx-exporter-probe-<hostname>-<index>, or the name of the module instead of the index
 	ClientID string `yaml:"client_id,omitempty"`
 	// Username is the MQTT username to use when probing.
 	Username string `yaml:"username,omitempty"`
 	// Password is the MQTT password to use when probing.
-	Password string `yaml:"password,omitempty"`
+	Password Secret `yaml:"password,omitempty"`
+	// PasswordFile is the file to read the MQTT password from, it's exclusive with Password.
+	PasswordFile string `yaml:"password_file,omitempty"`
 	// Topic is the MQTT topic to use when probing.
-	// Default: emqx-exporter-probe-<index>
+	// Default: emqx-exporter-probe/<hostname>/<index>, or the name of the module instead of the index
 	Topic string `yaml:"topic,omitempty"`
 	// QoS is the MQTT QoS to use when probing.
 	// Default: 0
 	QoS byte `yaml:"qos,omitempty"`
+	// QoSLevels are the MQTT QoS levels to probe in turn on /probe, it overrides QoS and the metrics are labelled by `qos`.
+	// Enum: [0 | 1 | 2]
+	// Default: QoS only
+	QoSLevels []int `yaml:"qos_levels,omitempty"`
 	// KeepAlive is the keep alive period in seconds. Defaults to 30 seconds.
 	KeepAlive int64 `yaml:"keep_alive,omitempty"`
 	// PingTimeout is the timeout in seconds for the MQTT ping request. Defaults to 10 seconds.
 	PingTimeout int64 `yaml:"ping_timeout,omitempty"`
 	// ConnectTimeout is the timeout in seconds for the MQTT connect request. Defaults to 30 seconds.
 	ConnectTimeout int64 `yaml:"connect_timeout,omitempty"`
+	// ProtocolVersion is the MQTT protocol version to use when probing, 3 for MQTT 3.1, 4 for MQTT 3.1.1 and 5 for MQTT 5.0.
+	// Enum: [3 | 4 | 5]
+	// Default: MQTT 3.1.1, falling back to MQTT 3.1
+	ProtocolVersion uint `yaml:"protocol_version,omitempty"`
+	// UserProperties are the user properties of the probe message, they're expected to be received with the message.
+	// MQTT 5 only.
+	UserProperties map[string]string `yaml:"user_properties,omitempty"`
+	// SessionExpiryInterval is the session expiry interval in seconds of the connection. MQTT 5 only.
+	// Default: 0, the session ends when the probe disconnects
+	SessionExpiryInterval uint32 `yaml:"session_expiry_interval,omitempty"`
+	// TopicAlias is the topic alias of the probe message, it must not exceed the topic alias maximum of the broker.
+	// MQTT 5 only.
+	// Default: 0, no topic alias
+	TopicAlias uint16 `yaml:"topic_alias,omitempty"`
+	// Interval is the interval in seconds of probing the target in the background, the results are accumulated
+	// by the metrics on /metrics.
+	// Default: 0, the target is only probed on /probe
+	Interval int64 `yaml:"interval,omitempty"`
+	// Persistent keeps one connection to the target for the background probe, which publishes a sequence-numbered
+	// message at every interval to detect the loss, duplication and reordering of messages. Requires Interval.
+	// Default: false, the background probe connects for every probe
+	Persistent bool `yaml:"persistent,omitempty"`
 	// TLSClientConfig is the TLS configuration to use when probing.
 	TLSClientConfig *TLSClientConfig `yaml:"tls_config,omitempty"`
 }
@@ -73,7 +325,7 @@ type TLSClientConfig struct {
 	CertData []byte `yaml:"cert_data,omitempty"`
 	// KeyData holds PEM-encoded bytes (typically read from a client certificate key file).
 	// KeyData takes precedence over KeyFile
-	KeyData []byte `yaml:"key_data,omitempty"`
+	KeyData Secret `yaml:"key_data,omitempty"`
 	// CAData holds PEM-encoded bytes (typically read from a root certificates bundle).
 	// CAData takes precedence over CAFile
 	CAData []byte `yaml:"ca_data,omitempty"`
@@ -81,7 +333,14 @@ type TLSClientConfig struct {
 
 type SafeConfig struct {
 	sync.RWMutex
-	C                   *Config
+	C *Config
+	// Validate is called to validate the loaded config before it's applied, if it's set.
+	Validate func(c *Config) error
+	// Apply is called to apply the validated config before it replaces C, if it's set. The config isn't
+	// committed if it fails, so Apply must leave the state as it was on failure.
+	Apply func(c *Config) error
+
+	secretFiles         []string
 	configReloadSuccess prometheus.Gauge
 	configReloadSeconds prometheus.Gauge
 }
@@ -112,126 +371,376 @@ func (sc *SafeConfig) ReloadConfig(confFile string) (err error) {
 		}
 	}()
 
-	yamlReader, err := os.Open(confFile)
+	content, err := os.ReadFile(confFile)
 	if err != nil {
 		return fmt.Errorf("error reading config file: %s", err)
 	}
-	defer yamlReader.Close()
-	decoder := yaml.NewDecoder(yamlReader)
+	decoder := yaml.NewDecoder(bytes.NewReader(expandEnv(content)))
 	decoder.KnownFields(true)
 
 	if err = decoder.Decode(c); err != nil {
 		return fmt.Errorf("error parsing config file: %s", err)
 	}
 
-	if c.Metrics != nil {
-		if c.Metrics.APIKey == "" {
-			return fmt.Errorf("metrics.api_key is required")
+	var tlsFileList, secretFiles []string
+	names := make(map[string]struct{}, len(c.Metrics))
+	for index, metrics := range c.Metrics {
+		if metrics == nil {
+			return fmt.Errorf("metrics[%d] is empty", index)
 		}
-		if c.Metrics.APISecret == "" {
-			return fmt.Errorf("metrics.api_secret is required")
+		if metrics.APIKey == "" {
+			return fmt.Errorf("metrics[%d].api_key is required", index)
 		}
-		if c.Metrics.Target == "" {
-			return fmt.Errorf("metrics.target is required")
-		}
-		if c.Metrics.TLSClientConfig != nil {
-			if c.Metrics.Scheme == "" {
-				c.Metrics.Scheme = "https"
+		if metrics.APISecretFile != "" {
+			if metrics.APISecret != "" {
+				return fmt.Errorf("metrics[%d].api_secret and metrics[%d].api_secret_file are mutually exclusive", index, index)
 			}
-			if c.Metrics.TLSClientConfig.CAData, err = dataFromSliceOrFile(c.Metrics.TLSClientConfig.CAData, c.Metrics.TLSClientConfig.CAFile); err != nil {
-				return fmt.Errorf("metrics.ssl_config.ca_data: %s", err)
+			if metrics.APISecret, err = readSecretFile(metrics.APISecretFile); err != nil {
+				return fmt.Errorf("metrics[%d].api_secret_file: %s", index, err)
 			}
-			if c.Metrics.TLSClientConfig.CertData, err = dataFromSliceOrFile(c.Metrics.TLSClientConfig.CertData, c.Metrics.TLSClientConfig.CertFile); err != nil {
-				return fmt.Errorf("metrics.ssl_config.cert_data: %s", err)
+			secretFiles = append(secretFiles, metrics.APISecretFile)
+		}
+		if metrics.APISecret == "" {
+			return fmt.Errorf("metrics[%d].api_secret is required", index)
+		}
+		if metrics.Target == "" {
+			return fmt.Errorf("metrics[%d].target is required", index)
+		}
+		if metrics.Name == "" {
+			metrics.Name = metrics.Target
+		}
+		if _, ok := names[metrics.Name]; ok {
+			return fmt.Errorf("metrics[%d].name %q is duplicated", index, metrics.Name)
+		}
+		names[metrics.Name] = struct{}{}
+		if metrics.TLSClientConfig != nil {
+			if metrics.Scheme == "" {
+				metrics.Scheme = "https"
 			}
-			if c.Metrics.TLSClientConfig.KeyData, err = dataFromSliceOrFile(c.Metrics.TLSClientConfig.KeyData, c.Metrics.TLSClientConfig.KeyFile); err != nil {
-				return fmt.Errorf("metrics.ssl_config.key_data: %s", err)
+			if err = metrics.TLSClientConfig.loadFiles(); err != nil {
+				return fmt.Errorf("metrics[%d].tls_config: %s", index, err)
 			}
+			tlsFileList = append(tlsFileList, metrics.TLSClientConfig.files()...)
+		}
+		if metrics.Scheme == "" {
+			metrics.Scheme = "http"
+		}
+		if metrics.MaxConcurrentRequests < 0 {
+			return fmt.Errorf("metrics[%d].max_concurrent_requests must be positive", index)
+		}
+		if metrics.MaxConcurrentRequests == 0 {
+			metrics.MaxConcurrentRequests = DefaultMaxConcurrentRequests
+		}
+		if metrics.HTTP == nil {
+			metrics.HTTP = &HTTPClientConfig{}
+		}
+		if err = metrics.HTTP.validate(fmt.Sprintf("metrics[%d].http", index)); err != nil {
+			return err
 		}
-		if c.Metrics.Scheme == "" {
-			c.Metrics.Scheme = "http"
+		metrics.HTTP.setDefaults(metrics.MaxConcurrentRequests)
+		if cache := metrics.Cache; cache != nil {
+			if cache.Interval <= 0 {
+				return fmt.Errorf("metrics[%d].cache.interval must be positive", index)
+			}
+			for collector, interval := range cache.Intervals {
+				if interval <= 0 {
+					return fmt.Errorf("metrics[%d].cache.intervals.%s must be positive", index, collector)
+				}
+			}
+			if cache.MaxStaleness < 0 {
+				return fmt.Errorf("metrics[%d].cache.max_staleness must not be negative", index)
+			}
 		}
 	}
 
+	// The background probes are identified by their target and module, by which their metrics are labeled.
+	background := make(map[[2]string]int)
 	for index, probe := range c.Probes {
+		if (probe.PublishTarget == "") != (probe.SubscribeTarget == "") {
+			return fmt.Errorf("probes[%d].publish_target and probes[%d].subscribe_target must be set together", index, index)
+		}
+		if probe.Target == "" && probe.PublishTarget != "" {
+			probe.Target = probe.PublishTarget + "->" + probe.SubscribeTarget
+		}
 		if probe.Target == "" {
 			return fmt.Errorf("probes[%d].target is required", index)
 		}
-		if probe.TLSClientConfig != nil {
-			if probe.Scheme == "" {
-				probe.Scheme = "ssl"
-			}
-			if probe.TLSClientConfig.CAData, err = dataFromSliceOrFile(probe.TLSClientConfig.CAData, probe.TLSClientConfig.CAFile); err != nil {
-				return fmt.Errorf("probes[%d].ssl_config.ca_data: %s", index, err)
-			}
-			if probe.TLSClientConfig.CertData, err = dataFromSliceOrFile(probe.TLSClientConfig.CertData, probe.TLSClientConfig.CertFile); err != nil {
-				return fmt.Errorf("probes[%d].ssl_config.cert_data: %s", index, err)
+		files, secrets, err := probe.validate(fmt.Sprintf("probes[%d]", index), strconv.Itoa(index))
+		if err != nil {
+			return err
+		}
+		tlsFileList = append(tlsFileList, files...)
+		secretFiles = append(secretFiles, secrets...)
+		if probe.Interval > 0 {
+			module := probe.Module
+			if module == "" {
+				module = ProbeModulePubSub
 			}
-			if probe.TLSClientConfig.KeyData, err = dataFromSliceOrFile(probe.TLSClientConfig.KeyData, probe.TLSClientConfig.KeyFile); err != nil {
-				return fmt.Errorf("probes[%d].ssl_config.key_data: %s", index, err)
+			key := [2]string{probe.Target, module}
+			if i, ok := background[key]; ok {
+				return fmt.Errorf("probes[%d] has the same target and module as probes[%d], both with interval", index, i)
 			}
+			background[key] = index
 		}
-		if probe.Scheme == "" {
-			probe.Scheme = "tcp"
+		c.Probes[index] = probe
+	}
+
+	// The modules are validated in the order of their names, so that the error is stable.
+	moduleNames := make([]string, 0, len(c.Modules))
+	for name := range c.Modules {
+		moduleNames = append(moduleNames, name)
+	}
+	sort.Strings(moduleNames)
+	for _, name := range moduleNames {
+		module, field := c.Modules[name], "modules."+name
+		switch name {
+		case "", ProbeModulePubSub, ProbeModuleRetained, ProbeModuleWill, ProbeModuleShared, ProbeModuleSession:
+			return fmt.Errorf("%s: the name is reserved for the modules of probes", field)
 		}
-		if probe.ClientID == "" {
-			hostname, _ := os.Hostname()
-			hostname = strings.Replace(hostname, ".", "-", -1)
-			probe.ClientID = fmt.Sprintf("emqx-exporter-probe-%s-%d", hostname, index)
+		if module.Target != "" || module.PublishTarget != "" || module.SubscribeTarget != "" {
+			return fmt.Errorf("%s.target is given by the target parameter of /probe", field)
 		}
-		if probe.Topic == "" {
-			hostname, _ := os.Hostname()
-			hostname = strings.Replace(hostname, ".", "-", -1)
-			probe.Topic = fmt.Sprintf("emqx-exporter-probe/%s/%d", hostname, index)
+		if module.Interval != 0 || module.Persistent {
+			return fmt.Errorf("%s.interval and %s.persistent require a target", field, field)
 		}
-		if probe.KeepAlive == 0 {
-			probe.KeepAlive = 30
+		files, secrets, err := module.validate(field, name)
+		if err != nil {
+			return err
 		}
-		if probe.PingTimeout == 0 {
-			probe.PingTimeout = 10
+		tlsFileList = append(tlsFileList, files...)
+		secretFiles = append(secretFiles, secrets...)
+		c.Modules[name] = module
+	}
+
+	if sc.Validate != nil {
+		if err = sc.Validate(c); err != nil {
+			return err
 		}
-		if probe.ConnectTimeout == 0 {
-			probe.ConnectTimeout = 30
+	}
+	if sc.Apply != nil {
+		if err = sc.Apply(c); err != nil {
+			return err
 		}
-
-		c.Probes[index] = probe
 	}
 
+	tlsFiles.retain(tlsFileList)
+
 	sc.Lock()
 	sc.C = c
+	sc.secretFiles = secretFiles
 	sc.Unlock()
 
 	return nil
 }
 
-func (conf *TLSClientConfig) ToTLSConfig() *tls.Config {
-	if conf == nil {
-		return nil
+// validate validates the probe of the field and sets its defaults, the default client ID and topic end with id.
+// It returns the TLS files and the secret files of the probe.
+func (probe *Probe) validate(field, id string) (tlsFiles, secretFiles []string, err error) {
+	if probe.TLSClientConfig != nil {
+		if probe.Scheme == "" {
+			probe.Scheme = "ssl"
+		}
+		if err = probe.TLSClientConfig.loadFiles(); err != nil {
+			return nil, nil, fmt.Errorf("%s.tls_config: %s", field, err)
+		}
+		tlsFiles = append(tlsFiles, probe.TLSClientConfig.files()...)
 	}
-	certpool := x509.NewCertPool()
-	certpool.AppendCertsFromPEM(conf.CAData)
-	clientKeyPair, _ := tls.X509KeyPair(conf.CertData, conf.KeyData)
-	return &tls.Config{
-		InsecureSkipVerify: conf.InsecureSkipVerify,
-		RootCAs:            certpool,
-		Certificates:       []tls.Certificate{clientKeyPair},
-		ClientAuth:         tls.NoClientCert,
-		ClientCAs:          nil,
+	if probe.Scheme == "" {
+		probe.Scheme = "tcp"
 	}
-}
-
-// dataFromSliceOrFile returns data from the slice (if non-empty), or from the file,
-// or an error if an error occurred reading the file
-func dataFromSliceOrFile(data []byte, file string) ([]byte, error) {
-	if len(data) > 0 {
-		return data, nil
+	if probe.WSPath != "" && !strings.HasPrefix(probe.WSPath, "/") {
+		return nil, nil, fmt.Errorf("%s.ws_path must start with /", field)
 	}
-	if len(file) > 0 {
-		fileData, err := os.ReadFile(file)
-		if err != nil {
-			return []byte{}, err
+	if probe.WSSubprotocol == "" {
+		probe.WSSubprotocol = "mqtt"
+	}
+	if err = validateProxyURL(field, probe.ProxyURL); err != nil {
+		return nil, nil, err
+	}
+	if probe.PasswordFile != "" {
+		if probe.Password != "" {
+			return nil, nil, fmt.Errorf("%s.password and %s.password_file are mutually exclusive", field, field)
+		}
+		if probe.Password, err = readSecretFile(probe.PasswordFile); err != nil {
+			return nil, nil, fmt.Errorf("%s.password_file: %s", field, err)
+		}
+		secretFiles = append(secretFiles, probe.PasswordFile)
+	}
+	if probe.ClientID == "" {
+		hostname, _ := os.Hostname()
+		hostname = strings.Replace(hostname, ".", "-", -1)
+		probe.ClientID = fmt.Sprintf("emqx-exporter-probe-%s-%s", hostname, id)
+	}
+	if probe.Topic == "" {
+		hostname, _ := os.Hostname()
+		hostname = strings.Replace(hostname, ".", "-", -1)
+		probe.Topic = fmt.Sprintf("emqx-exporter-probe/%s/%s", hostname, id)
+	}
+	if probe.KeepAlive == 0 {
+		probe.KeepAlive = 30
+	}
+	if probe.PingTimeout == 0 {
+		probe.PingTimeout = 10
+	}
+	if probe.ConnectTimeout == 0 {
+		probe.ConnectTimeout = 30
+	}
+	if probe.Interval < 0 {
+		return nil, nil, fmt.Errorf("%s.interval must not be negative", field)
+	}
+	levels := make(map[int]struct{}, len(probe.QoSLevels))
+	for _, qos := range probe.QoSLevels {
+		if qos < 0 || qos > 2 {
+			return nil, nil, fmt.Errorf("%s.qos_levels must be 0, 1 or 2", field)
+		}
+		if _, ok := levels[qos]; ok {
+			return nil, nil, fmt.Errorf("%s.qos_levels has duplicated level %d", field, qos)
+		}
+		levels[qos] = struct{}{}
+	}
+	switch probe.Module {
+	case "", ProbeModulePubSub, ProbeModuleRetained, ProbeModuleWill:
+	case ProbeModuleShared:
+		if probe.SharedGroup == "" {
+			probe.SharedGroup = "emqx-exporter"
+		}
+		if strings.ContainsAny(probe.SharedGroup, "/+#") {
+			return nil, nil, fmt.Errorf("%s.shared_group must not contain /, + or #", field)
+		}
+		if probe.SharedSubscribers == 0 {
+			probe.SharedSubscribers = 2
+		}
+		if probe.SharedMessages == 0 {
+			probe.SharedMessages = 10
+		}
+		if probe.SharedSubscribers < 0 || probe.SharedMessages < 0 {
+			return nil, nil, fmt.Errorf("%s.shared_subscribers and %s.shared_messages must be positive", field, field)
+		}
+	case ProbeModuleSession:
+		if probe.SessionMessages == 0 {
+			probe.SessionMessages = 3
+		}
+		if probe.SessionMessages < 0 {
+			return nil, nil, fmt.Errorf("%s.session_messages must be positive", field)
+		}
+		// The messages of QoS 0 may not be queued for the offline session.
+		if probe.QoS == 0 && len(probe.QoSLevels) == 0 {
+			return nil, nil, fmt.Errorf("%s.module session requires qos 1 or 2", field)
+		}
+		for _, qos := range probe.QoSLevels {
+			if qos == 0 {
+				return nil, nil, fmt.Errorf("%s.module session requires qos 1 or 2", field)
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("%s.module must be pubsub, retained, will, shared or session", field)
+	}
+	switch probe.Expect {
+	case "":
+	case ProbeExpectConnectRefused, ProbeExpectSubscribeDenied, ProbeExpectPublishDenied:
+		if probe.Module != "" && probe.Module != ProbeModulePubSub {
+			return nil, nil, fmt.Errorf("%s.expect requires module pubsub", field)
+		}
+		if probe.Persistent {
+			return nil, nil, fmt.Errorf("%s.expect and %s.persistent are mutually exclusive", field, field)
 		}
-		return fileData, nil
+	default:
+		return nil, nil, fmt.Errorf("%s.expect must be connect_refused, subscribe_denied or publish_denied", field)
+	}
+	if probe.ResumeTarget != "" && probe.Module != ProbeModuleSession {
+		return nil, nil, fmt.Errorf("%s.resume_target requires module session", field)
+	}
+	if probe.Persistent && probe.Interval == 0 {
+		return nil, nil, fmt.Errorf("%s.persistent requires interval", field)
+	}
+	if probe.Persistent && probe.Module != "" && probe.Module != ProbeModulePubSub {
+		return nil, nil, fmt.Errorf("%s.persistent requires module pubsub", field)
+	}
+	switch probe.ProtocolVersion {
+	case 0, 3, 4:
+		if len(probe.UserProperties) > 0 {
+			return nil, nil, fmt.Errorf("%s.user_properties requires protocol_version 5", field)
+		}
+		if probe.SessionExpiryInterval > 0 {
+			return nil, nil, fmt.Errorf("%s.session_expiry_interval requires protocol_version 5", field)
+		}
+		if probe.TopicAlias > 0 {
+			return nil, nil, fmt.Errorf("%s.topic_alias requires protocol_version 5", field)
+		}
+	case 5:
+	default:
+		return nil, nil, fmt.Errorf("%s.protocol_version must be 3, 4 or 5", field)
+	}
+
+	return tlsFiles, secretFiles, nil
+}
+
+// Secret is a string which is marshalled as "<secret>", so that the /config endpoint doesn't expose it.
+type Secret string
+
+const secretToken = "<secret>"
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	if s != "" {
+		return secretToken, nil
 	}
 	return nil, nil
 }
+
+// SecretURL is a URL whose password is marshalled as "<secret>", e.g. `http://user:<secret>@proxy:3128`,
+// so that the /config endpoint doesn't expose the credentials of a proxy.
+type SecretURL string
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (u SecretURL) MarshalYAML() (interface{}, error) {
+	if u == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(string(u))
+	if err != nil {
+		// The URL isn't parsed, it may be anything including the credentials.
+		return secretToken, nil
+	}
+	if _, ok := parsed.User.Password(); !ok {
+		return string(u), nil
+	}
+	userinfo := url.User(parsed.User.Username()).String() + ":" + secretToken + "@"
+	parsed.User = nil
+	return strings.Replace(parsed.String(), "//", "//"+userinfo, 1), nil
+}
+
+var envRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} in the config file with the value of the environment variable,
+// an unset variable is replaced with the empty string. The $VAR form isn't expanded,
+// as `$` is commonly used in MQTT topics, e.g. `$share/group/topic`.
+func expandEnv(content []byte) []byte {
+	return envRegex.ReplaceAllFunc(content, func(match []byte) []byte {
+		return []byte(os.Getenv(string(envRegex.FindSubmatch(match)[1])))
+	})
+}
+
+// readSecretFile reads the secret from the file, the trailing newline is trimmed.
+func readSecretFile(file string) (Secret, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return Secret(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+// validateProxyURL returns an error unless the proxy URL of the field is empty, or a proxy by CONNECT or SOCKS5.
+func validateProxyURL(field string, proxy SecretURL) error {
+	if proxy == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(string(proxy))
+	if err != nil {
+		return fmt.Errorf("%s.proxy_url: %s", field, err)
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5") || proxyURL.Host == "" {
+		return fmt.Errorf("%s.proxy_url must be http://host:port or socks5://host:port", field)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// tlsFiles caches the content of the TLS files referenced by the config.
+// It's refreshed by the config watcher, so that rotated certificates are used by new connections.
+var tlsFiles = &fileStore{files: make(map[string][]byte)}
+
+type fileStore struct {
+	mtx        sync.RWMutex
+	files      map[string][]byte
+	generation uint64
+}
+
+// read reads the file from disk and caches it.
+func (s *fileStore) read(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if old, ok := s.files[file]; !ok || !bytes.Equal(old, data) {
+		s.files[file] = data
+		s.generation++
+	}
+	return data, nil
+}
+
+// get returns the cached content of the file, the file will be read if it isn't cached.
+func (s *fileStore) get(file string) ([]byte, error) {
+	s.mtx.RLock()
+	data, ok := s.files[file]
+	s.mtx.RUnlock()
+	if ok {
+		return data, nil
+	}
+	return s.read(file)
+}
+
+// currentGeneration returns a number which is increased whenever any file content changes.
+func (s *fileStore) currentGeneration() uint64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.generation
+}
+
+// list returns the names of the cached files.
+func (s *fileStore) list() []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	files := make([]string, 0, len(s.files))
+	for file := range s.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// retain drops the cached files which are not in the list.
+func (s *fileStore) retain(files []string) {
+	keep := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		keep[file] = struct{}{}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for file := range s.files {
+		if _, ok := keep[file]; !ok {
+			delete(s.files, file)
+		}
+	}
+}
+
+// refresh re-reads all cached files and returns the names of the changed ones.
+// A file which can't be read keeps its cached content, as it may be in the middle of a rotation.
+func (s *fileStore) refresh() (changed []string, err error) {
+	for _, file := range s.list() {
+		s.mtx.RLock()
+		old := s.files[file]
+		s.mtx.RUnlock()
+
+		data, readErr := s.read(file)
+		if readErr != nil {
+			err = readErr
+			continue
+		}
+		if !bytes.Equal(old, data) {
+			changed = append(changed, file)
+		}
+	}
+	return
+}
+
+// files returns the TLS files which have no inline data.
+func (conf *TLSClientConfig) files() []string {
+	var files []string
+	if len(conf.CAData) == 0 && conf.CAFile != "" {
+		files = append(files, conf.CAFile)
+	}
+	if len(conf.CertData) == 0 && conf.CertFile != "" {
+		files = append(files, conf.CertFile)
+	}
+	if len(conf.KeyData) == 0 && conf.KeyFile != "" {
+		files = append(files, conf.KeyFile)
+	}
+	return files
+}
+
+// loadFiles reads the TLS files which have no inline data, so that errors are reported on loading.
+func (conf *TLSClientConfig) loadFiles() error {
+	for _, file := range conf.files() {
+		if _, err := tlsFiles.read(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToTLSConfig returns the TLS config of the connections to the server, whose certificate is verified for
+// the serverName, i.e. the host of the target. The name is kept by the config, as the server name of the
+// connection state is empty for an IP address, which isn't sent by SNI.
+func (conf *TLSClientConfig) ToTLSConfig(serverName string) *tls.Config {
+	if conf == nil {
+		return nil
+	}
+
+	if len(conf.files()) == 0 {
+		certpool := x509.NewCertPool()
+		certpool.AppendCertsFromPEM(conf.CAData)
+		clientKeyPair, _ := tls.X509KeyPair(conf.CertData, []byte(conf.KeyData))
+		return &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: conf.InsecureSkipVerify,
+			RootCAs:            certpool,
+			Certificates:       []tls.Certificate{clientKeyPair},
+			ClientAuth:         tls.NoClientCert,
+			ClientCAs:          nil,
+		}
+	}
+
+	// The certificates are loaded on every handshake from the cached files, so that the
+	// rotated ones are used by new connections without rebuilding the clients.
+	// The server certificate is verified by VerifyConnection against the current root CAs,
+	// which is left unset if the verification is skipped.
+	m := &tlsMaterial{conf: conf, serverName: serverName}
+	tlsConfig := &tls.Config{
+		ServerName:           serverName,
+		InsecureSkipVerify:   true,
+		GetClientCertificate: m.getClientCertificate,
+		ClientAuth:           tls.NoClientCert,
+		ClientCAs:            nil,
+	}
+	if !conf.InsecureSkipVerify {
+		tlsConfig.VerifyConnection = m.verifyConnection
+	} else if rootCAs, _, err := m.load(); err == nil {
+		// The root CAs aren't used by the connections, but by the TLS metrics which still verify the chain.
+		tlsConfig.RootCAs = rootCAs
+	}
+	return tlsConfig
+}
+
+// tlsMaterial holds the certificates parsed from the TLS files, they are parsed again when any file changes.
+type tlsMaterial struct {
+	conf *TLSClientConfig
+	// serverName is the name verified by the certificate of the server.
+	serverName string
+
+	mtx        sync.Mutex
+	loaded     bool
+	generation uint64
+	rootCAs    *x509.CertPool
+	clientCert *tls.Certificate
+}
+
+func (m *tlsMaterial) load() (*x509.CertPool, *tls.Certificate, error) {
+	generation := tlsFiles.currentGeneration()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.loaded && m.generation == generation {
+		return m.rootCAs, m.clientCert, nil
+	}
+
+	dataOf := func(data []byte, file string) ([]byte, error) {
+		if len(data) > 0 || file == "" {
+			return data, nil
+		}
+		return tlsFiles.get(file)
+	}
+	caData, err := dataOf(m.conf.CAData, m.conf.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load ca file failed: %s", err)
+	}
+	certData, err := dataOf(m.conf.CertData, m.conf.CertFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load cert file failed: %s", err)
+	}
+	keyData, err := dataOf([]byte(m.conf.KeyData), m.conf.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load key file failed: %s", err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(caData)
+	clientCert, _ := tls.X509KeyPair(certData, keyData)
+
+	m.loaded = true
+	m.generation = generation
+	m.rootCAs = rootCAs
+	m.clientCert = &clientCert
+	return m.rootCAs, m.clientCert, nil
+}
+
+func (m *tlsMaterial) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, clientCert, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	return clientCert, nil
+}
+
+func (m *tlsMaterial) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("tls: server didn't provide a certificate")
+	}
+
+	rootCAs, _, err := m.load()
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       m.serverName,
+		Roots:         rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSConfigRotation(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	copyFile(t, "example/certs/client-cert.pem", certFile)
+	copyFile(t, "example/certs/client-key.pem", keyFile)
+
+	conf := &TLSClientConfig{CertFile: certFile, KeyFile: keyFile}
+	if err := conf.loadFiles(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := conf.ToTLSConfig("127.0.0.1")
+
+	before, err := tlsConfig.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before.Certificate) == 0 {
+		t.Fatal("Expected a client certificate")
+	}
+
+	copyFile(t, "example/certs/cert.pem", certFile)
+	copyFile(t, "example/certs/key.pem", keyFile)
+	changed, err := tlsFiles.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 {
+		t.Errorf("Expected 2 changed files but got %v", changed)
+	}
+
+	after, err := tlsConfig.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before.Certificate[0], after.Certificate[0]) {
+		t.Error("Expected the rotated client certificate to be used")
+	}
+}
+
+func TestTLSConfigVerifiesServerName(t *testing.T) {
+	// The certificate of the server is signed by the CA, but has no subject alternative names.
+	cert, err := tls.LoadX509KeyPair("example/certs/cert.pem", "example/certs/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	testcases := []struct {
+		name string
+		conf *TLSClientConfig
+	}{
+		{name: "static", conf: &TLSClientConfig{CAData: mustReadFile(t, "example/certs/cacert.pem")}},
+		{name: "files", conf: &TLSClientConfig{CAFile: "example/certs/cacert.pem"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.conf.loadFiles(); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), tc.conf.ToTLSConfig("127.0.0.1"))
+			if err == nil {
+				conn.Close()
+			}
+			var hostnameErr x509.HostnameError
+			if !errors.As(err, &hostnameErr) {
+				t.Errorf("Expected the certificate without IP SANs to be refused for 127.0.0.1, got %v", err)
+			}
+		})
+	}
+}
+
+func mustReadFile(t *testing.T, file string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWatchReloadsConfig(t *testing.T) {
+	file := writeConfigFile(t, "probes:\n  - target: 127.0.0.1:1883\n")
+	sc := NewSafeConfig(nil)
+
+	reloaded := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		_ = sc.Watch(done, file, 10*time.Millisecond, log.NewNopLogger(), func() error {
+			select {
+			case reloaded <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+	}()
+
+	// wait for the watcher to be ready, the file is written until the reload is observed
+	deadline := time.After(5 * time.Second)
+	for {
+		if err := os.WriteFile(file, []byte("probes:\n  - target: 127.0.0.1:1883\n"+"# "+time.Now().String()+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-reloaded:
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected the config to be reloaded")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Watch watches the config file and the TLS and secret files referenced by the config until done is closed.
+// The directories of the files are watched instead of the files themselves, as the mounted
+// Kubernetes ConfigMaps and Secrets are updated by swapping symlinks.
+// Events are debounced, then reload is called if the content of the config file or any secret file
+// has changed, and the TLS files are read again, so that new connections use the rotated certificates.
+func (sc *SafeConfig) Watch(done <-chan struct{}, confFile string, debounce time.Duration, logger log.Logger, reload func() error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// the content of the config file and the secret files, reload is needed if any of them changes
+	contents := make(map[string][]byte)
+	snapshot := func() {
+		sc.RLock()
+		files := append([]string{confFile}, sc.secretFiles...)
+		sc.RUnlock()
+
+		for file := range contents {
+			delete(contents, file)
+		}
+		for _, file := range files {
+			contents[file], _ = os.ReadFile(file)
+		}
+	}
+	changed := func() bool {
+		for file, content := range contents {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error reading file", "file", file, "err", err)
+				continue
+			}
+			if !bytes.Equal(data, content) {
+				level.Info(logger).Log("msg", "File changed, reloading config", "file", file)
+				return true
+			}
+		}
+		return false
+	}
+
+	watchedDirs := make(map[string]struct{})
+	syncDirs := func() {
+		for _, file := range append(tlsFiles.list(), keys(contents)...) {
+			dir := filepath.Dir(file)
+			if _, ok := watchedDirs[dir]; ok {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				level.Error(logger).Log("msg", "Failed to watch directory", "dir", dir, "err", err)
+				continue
+			}
+			level.Debug(logger).Log("msg", "Watching directory", "dir", dir)
+			watchedDirs[dir] = struct{}{}
+		}
+	}
+	snapshot()
+	syncDirs()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-done:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			level.Debug(logger).Log("msg", "Received file event", "event", event)
+			timer = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			level.Error(logger).Log("msg", "Error watching files", "err", err)
+		case <-timer:
+			timer = nil
+
+			if changed() {
+				if err := reload(); err != nil {
+					level.Error(logger).Log("msg", "Error reloading config", "err", err)
+				}
+				snapshot()
+			}
+
+			changedTLSFiles, err := tlsFiles.refresh()
+			if err != nil {
+				level.Warn(logger).Log("msg", "Error reading TLS file, the previous content is kept", "err", err)
+			}
+			for _, file := range changedTLSFiles {
+				level.Info(logger).Log("msg", "TLS file changed", "file", file)
+			}
+			syncDirs()
+		}
+	}
+}
+
+func keys(m map[string][]byte) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
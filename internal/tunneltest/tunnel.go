@@ -0,0 +1,47 @@
+// Package tunneltest tunnels the CONNECT requests like an HTTP proxy, for the fake servers of the tests.
+package tunneltest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Tunneler tunnels the CONNECT requests and counts them, the zero value is ready to use.
+type Tunneler struct {
+	mtx     sync.Mutex
+	tunnels int
+}
+
+// Tunnels returns the number of the CONNECT requests tunneled.
+func (t *Tunneler) Tunnels() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tunnels
+}
+
+// Tunnel connects to the host of the CONNECT request and copies the data both ways until either side closes.
+func (t *Tunneler) Tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	t.mtx.Lock()
+	t.tunnels++
+	t.mtx.Unlock()
+
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		_, _ = io.Copy(upstream, buf)
+		upstream.Close()
+	}()
+	_, _ = io.Copy(conn, upstream)
+	conn.Close()
+}
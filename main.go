@@ -18,11 +18,14 @@ import (
 	"emqx-exporter/config"
 	"emqx-exporter/prober"
 
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/common/promlog"
@@ -45,11 +48,16 @@ func main() {
 func run(app *kingpin.Application, args []string, srv *http.Server) (exitCode int) {
 	var (
 		configFile             = app.Flag("config.file", "EMQX exporter configuration file.").Default(filepath.Join(filepath.Dir(os.Args[0]), "config.yaml")).String()
+		watchConfig            = app.Flag("config.watch", "Watch the configuration file and the TLS files referenced by it, and reload them on change.").Bool()
+		watchDebounce          = app.Flag("config.watch-debounce", "Time to wait for further changes before reloading the watched files.").Default("2s").Duration()
 		maxProcs               = app.Flag("runtime.gomaxprocs", "The target number of CPUs Go will run on (GOMAXPROCS)").Envar("GOMAXPROCS").Default("4").Int()
 		maxRequests            = app.Flag("web.max-requests", "Maximum number of parallel scrape requests. Use 0 to disable.").Default("40").Int()
 		disableExporterMetrics = app.Flag("web.disable-exporter-metrics", "Exclude metrics about the exporter itself (promhttp_*, process_*, go_*).").Bool()
+		enableLifecycle        = app.Flag("web.enable-lifecycle", "Enable reloading the configuration via HTTP POST to /-/reload.").Bool()
+		timeoutOffset          = app.Flag("scrape.timeout-offset", "Offset to subtract from the timeout of Prometheus scrapes given by X-Prometheus-Scrape-Timeout-Seconds.").Default("0.5s").Duration()
 		toolkitFlags           = kingpinflag.AddFlags(app, ":8085")
 	)
+	collector.AddFlags(app)
 	app.Version(version.Print("emqx-exporter"))
 	app.UsageWriter(os.Stdout)
 	app.HelpFlag.Short('h')
@@ -67,20 +75,104 @@ func run(app *kingpin.Application, args []string, srv *http.Server) (exitCode in
 	runtime.GOMAXPROCS(*maxProcs)
 	level.Debug(logger).Log("msg", "Go MAXPROCS", "procs", runtime.GOMAXPROCS(0))
 
+	sc.Validate = func(c *config.Config) error {
+		for index, metrics := range c.Metrics {
+			if err := collector.ValidateCollectors(metrics.Collectors); err != nil {
+				return fmt.Errorf("metrics[%d].collectors: %s", index, err)
+			}
+			if metrics.Cache != nil {
+				for name := range metrics.Cache.Intervals {
+					if err := collector.ValidateCollectors([]string{name}); err != nil {
+						return fmt.Errorf("metrics[%d].cache.intervals: %s", index, err)
+					}
+				}
+			}
+		}
+		return nil
+	}
 	if err := sc.ReloadConfig(*configFile); err != nil {
 		level.Error(logger).Log("msg", "Error loading config", "err", err)
 		return 1
 	}
 	level.Info(logger).Log("msg", "Loaded config file")
 
+	// The metrics of the background probes are served by /metrics even without the exporter metrics.
+	probeRegistry := prometheus.NewRegistry()
+	scheduler := prober.NewScheduler(probeRegistry, logger)
+	metricsHandler := collector.NewHandler(probeRegistry, *disableExporterMetrics, *maxRequests, *timeoutOffset, sc.C.Metrics, logger)
+	scheduler.Reload(sc.C.Probes)
+	defer scheduler.Stop()
+	// The reloaded config is committed only once it's been applied, the handler is reloaded first as it may fail
+	// and then it's left as it was.
+	sc.Apply = func(c *config.Config) error {
+		if err := metricsHandler.Reload(c.Metrics); err != nil {
+			return err
+		}
+		scheduler.Reload(c.Probes)
+		return nil
+	}
+
+	hup := make(chan os.Signal, 1)
+	reloadCh := make(chan chan error)
+	done := make(chan struct{})
+	defer close(done)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := sc.ReloadConfig(*configFile); err != nil {
+					level.Error(logger).Log("msg", "Error reloading config", "err", err)
+					continue
+				}
+				level.Info(logger).Log("msg", "Reloaded config file")
+			case rc := <-reloadCh:
+				if err := sc.ReloadConfig(*configFile); err != nil {
+					level.Error(logger).Log("msg", "Error reloading config", "err", err)
+					rc <- err
+				} else {
+					level.Info(logger).Log("msg", "Reloaded config file")
+					rc <- nil
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if *watchConfig {
+		go func() {
+			err := sc.Watch(done, *configFile, *watchDebounce, logger, func() error {
+				rc := make(chan error)
+				select {
+				case reloadCh <- rc:
+					return <-rc
+				case <-done:
+					return nil
+				}
+			})
+			if err != nil {
+				level.Error(logger).Log("msg", "Error watching config files", "err", err)
+			}
+		}()
+	}
+
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", collector.NewHandler(*disableExporterMetrics, *maxRequests, sc.C.Metrics, logger))
+	mux.Handle("/metrics", metricsHandler)
 
 	mux.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		// The probe gives up by the scrape timeout, rather than waiting for the keep alive past it.
+		ctx, cancel, err := collector.ScrapeContext(r, *timeoutOffset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer cancel()
 		sc.Lock()
-		probes := sc.C.Probes
+		probes, modules := sc.C.Probes, sc.C.Modules
 		sc.Unlock()
-		prober.Handler(w, r, probes, logger, nil)
+		prober.Handler(w, r.WithContext(ctx), probes, modules, logger, nil)
 	})
 
 	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
@@ -96,6 +188,34 @@ func run(app *kingpin.Application, args []string, srv *http.Server) (exitCode in
 		w.Write(c)
 	})
 
+	if *enableLifecycle {
+		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				fmt.Fprintf(w, "This endpoint requires a POST request.\n")
+				return
+			}
+
+			// The result is buffered, so that the reload doesn't block on the request which has gone.
+			rc := make(chan error, 1)
+			select {
+			case reloadCh <- rc:
+			case <-r.Context().Done():
+				return
+			case <-done:
+				http.Error(w, "the exporter is shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			select {
+			case err := <-rc:
+				if err != nil {
+					http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+				}
+			case <-r.Context().Done():
+			}
+		})
+	}
+
 	landingConfig := web.LandingConfig{
 		Name:        "EMQX Exporter",
 		Description: "EMQX Exporter",
@@ -121,19 +121,23 @@ var _ = AfterSuite(func() {
 var _ = Describe("Check EMQX Exporter Metrics", Label("metics"), func() {
 	Context("check https", func() {
 		BeforeEach(func() {
+			// the api_secret is marshalled as <secret>, so it's passed by file
+			apiSecretFilePath := emqxExporter.binDir + "/api_secret"
+			Expect(os.WriteFile(apiSecretFilePath, []byte("some_api_secret"), 0644)).ToNot(HaveOccurred())
+
 			exporterConfig := config.Config{
-				Metrics: &config.Metrics{
-					APIKey:    "some_api_key",
-					APISecret: "some_api_secret",
-					Target:    "127.0.0.1:28084",
-					Scheme:    "https",
+				Metrics: config.MetricsList{{
+					APIKey:        "some_api_key",
+					APISecretFile: apiSecretFilePath,
+					Target:        "127.0.0.1:28084",
+					Scheme:        "https",
 					TLSClientConfig: &config.TLSClientConfig{
 						InsecureSkipVerify: true,
 						CAFile:             emqxExporter.binDir + "/certs/cacert.pem",
 						CertFile:           emqxExporter.binDir + "/certs/client-cert.pem",
 						KeyFile:            emqxExporter.binDir + "/certs/client-key.pem",
 					},
-				},
+				}},
 			}
 
 			configFile, _ := yaml.Marshal(exporterConfig)
@@ -2,11 +2,15 @@ package prober
 
 import (
 	"emqx-exporter/config"
+	"emqx-exporter/tlsinfo"
 
+	"context"
 	"fmt"
-
+	"hash/fnv"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-kit/log"
@@ -15,55 +19,334 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func Handler(w http.ResponseWriter, r *http.Request, probes []config.Probe, logger log.Logger, params url.Values) {
+func Handler(w http.ResponseWriter, r *http.Request, probes []config.Probe, modules map[string]config.Probe, logger log.Logger, params url.Values) {
 	var probe config.Probe
 	if params == nil {
 		params = r.URL.Query()
 	}
-	target := params.Get("target")
-	for i := 0; i < len(probes); i++ {
-		if probes[i].Target == target {
-			probe = probes[i]
-			break
+	target, module := params.Get("target"), params.Get("module")
+	if m, ok := modules[module]; ok {
+		if target == "" {
+			http.Error(w, fmt.Sprintf("Target parameter is required by module %q", module), http.StatusBadRequest)
+			return
+		}
+		probe = moduleProbe(m, target)
+	} else {
+		for i := 0; i < len(probes); i++ {
+			// The first probe of the target is taken if the module isn't given.
+			if probes[i].Target == target && (module == "" || probeModule(probes[i]) == module) {
+				probe = probes[i]
+				break
+			}
 		}
 	}
 	if probe.Target == "" {
-		http.Error(w, fmt.Sprintf("Unknown probe target %q", target), http.StatusBadRequest)
-		level.Debug(logger).Log("msg", "Unknown probe target", "target", target)
+		http.Error(w, fmt.Sprintf("Unknown probe target %q of module %q", target, module), http.StatusBadRequest)
+		level.Debug(logger).Log("msg", "Unknown probe target", "target", target, "module", module)
 		return
 	}
 
+	constLabels := prometheus.Labels{"target": probe.Target}
+	if probe.Module != "" {
+		constLabels["module"] = probeModule(probe)
+	}
+	// The cross-node probe is labelled by the pair of nodes, so that the routing between them can be told apart.
+	if probe.PublishTarget != "" {
+		constLabels["publish_target"] = probe.PublishTarget
+		constLabels["subscribe_target"] = probe.SubscribeTarget
+	}
+
+	registry := prometheus.NewRegistry()
+	if len(probe.QoSLevels) == 0 {
+		probeMetrics(r.Context(), registry, probe, constLabels, logger)
+	} else {
+		// The levels are probed in turn, so that they don't interfere with each other on the topic.
+		for _, qos := range probe.QoSLevels {
+			labels := prometheus.Labels{"qos": strconv.Itoa(qos)}
+			for name, value := range constLabels {
+				labels[name] = value
+			}
+			levelProbe := probe
+			levelProbe.QoS = byte(qos)
+			probeMetrics(r.Context(), registry, levelProbe, labels, logger)
+		}
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeMetrics probes the target until ctx is done and registers the metrics of the probe labelled by constLabels.
+func probeMetrics(ctx context.Context, registry *prometheus.Registry, probe config.Probe, constLabels prometheus.Labels, logger log.Logger) {
 	probeSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "emqx",
-		Subsystem: "mqtt",
-		Name:      "probe_success",
-		Help:      "Displays whether or not the probe was a success",
-		ConstLabels: prometheus.Labels{
-			"target": probe.Target,
-		},
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_success",
+		Help:        "Displays whether or not the probe was a success",
+		ConstLabels: constLabels,
 	})
 	probeDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "emqx",
-		Subsystem: "mqtt",
-		Name:      "probe_duration_seconds",
-		Help:      "Returns how long the probe took to complete in seconds",
-		ConstLabels: prometheus.Labels{
-			"target": probe.Target,
-		},
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_duration_seconds",
+		Help:        "Returns how long the probe took to complete in seconds",
+		ConstLabels: constLabels,
 	})
 
-	registry := prometheus.NewRegistry()
+	probePhaseDurationGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_phase_duration_seconds",
+		Help:        "Duration of the phases of the probe in seconds, the phases which haven't been reached are 0",
+		ConstLabels: constLabels,
+	}, []string{"phase"})
+	probeFailedPhaseGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_failed_phase",
+		Help:        "Displays the phase in which the probe failed with 1, all phases are 0 if the probe was a success",
+		ConstLabels: constLabels,
+	}, []string{"phase"})
+
 	registry.MustRegister(probeSuccessGauge)
 	registry.MustRegister(probeDurationGauge)
+	registry.MustRegister(probePhaseDurationGaugeVec)
+	registry.MustRegister(probeFailedPhaseGaugeVec)
 
 	start := time.Now()
-	mp := newMQTTProbe(probe, logger)
-	if mp != nil && mp.Probe(probe, logger) {
+	success, trace := probeOnce(ctx, probe, logger)
+	if success {
 		probeSuccessGauge.Set(1)
 	} else {
 		probeSuccessGauge.Set(0)
 	}
 
 	probeDurationGauge.Set(time.Since(start).Seconds())
-	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	failedPhase := trace.failedPhase()
+	for _, phase := range probePhases {
+		probePhaseDurationGaugeVec.WithLabelValues(phase).Set(trace.duration(phase).Seconds())
+		if phase == failedPhase {
+			probeFailedPhaseGaugeVec.WithLabelValues(phase).Set(1)
+		} else {
+			probeFailedPhaseGaugeVec.WithLabelValues(phase).Set(0)
+		}
+	}
+	// Only the received acknowledgements are reported, and MQTT 3 only has the return codes of CONNACK and SUBACK.
+	for _, packet := range reasonCodePackets {
+		code, ok := trace.reasonCode(packet)
+		if !ok {
+			continue
+		}
+		reasonCodeGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "emqx",
+			Subsystem:   "mqtt",
+			Name:        "probe_" + packet + "_reason_code",
+			Help:        fmt.Sprintf("Reason code, or return code of MQTT 3, of the %s received by the probe", strings.ToUpper(packet)),
+			ConstLabels: constLabels,
+		})
+		reasonCodeGauge.Set(float64(code))
+		registry.MustRegister(reasonCodeGauge)
+	}
+
+	if status, ok := trace.handshakeStatus(); ok {
+		wsStatusGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "emqx",
+			Subsystem:   "mqtt",
+			Name:        "probe_ws_handshake_status_code",
+			Help:        "HTTP status code of the response of the websocket handshake of the probe, 101 if it succeeded",
+			ConstLabels: constLabels,
+		})
+		wsStatusGauge.Set(float64(status))
+		registry.MustRegister(wsStatusGauge)
+	}
+	// The TLS metrics are only exposed by the probes over TLS.
+	registry.MustRegister(tlsinfo.NewCollector(trace.tls, constLabels))
+
+	if trace.shared != nil {
+		sharedMetrics(registry, trace.shared, constLabels)
+	}
+	if trace.session != nil {
+		sessionMetrics(registry, trace.session, constLabels)
+	}
+
+	// The acknowledgements and the DUP flag only exist for QoS 1 and 2.
+	if probe.QoS == 0 {
+		return
+	}
+	probeAckDurationGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_ack_duration_seconds",
+		Help:        "Duration of the acknowledgement stages of publishing the message of the probe in seconds, the stages which haven't completed are 0",
+		ConstLabels: constLabels,
+	}, []string{"stage"})
+	for _, stage := range ackStages(probe.QoS) {
+		probeAckDurationGaugeVec.WithLabelValues(stage).Set(trace.ackDuration(stage).Seconds())
+	}
+	probeDupGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_dup_received",
+		Help:        "Number of the messages redelivered with the DUP flag received by the probe",
+		ConstLabels: constLabels,
+	})
+	probeDupGauge.Set(float64(trace.dupsReceived()))
+	registry.MustRegister(probeAckDurationGaugeVec, probeDupGauge)
+}
+
+// sharedMetrics registers the metrics of the distribution of the messages of the shared module.
+func sharedMetrics(registry *prometheus.Registry, dist *sharedDistribution, constLabels prometheus.Labels) {
+	receivedGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_shared_received",
+		Help:        "Number of the messages received by every subscriber of the shared subscription, including the duplicates",
+		ConstLabels: constLabels,
+	}, []string{"subscriber"})
+	for i, received := range dist.receivedMessages() {
+		receivedGaugeVec.WithLabelValues(strconv.Itoa(i)).Set(float64(received))
+	}
+	missingGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_shared_missing",
+		Help:        "Number of the messages which haven't been received by any subscriber of the shared subscription within the keep alive",
+		ConstLabels: constLabels,
+	})
+	missingGauge.Set(float64(dist.missing()))
+	duplicatedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_shared_duplicated",
+		Help:        "Number of the messages received more than once by the subscribers of the shared subscription",
+		ConstLabels: constLabels,
+	})
+	duplicatedGauge.Set(float64(dist.duplicatedMessages()))
+	latencyGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_shared_latency_seconds",
+		Help:        "Average and maximum latency of the delivery of the messages to the shared subscription in seconds",
+		ConstLabels: constLabels,
+	}, []string{"stat"})
+	avg, maximum := dist.latency()
+	latencyGaugeVec.WithLabelValues("avg").Set(avg.Seconds())
+	latencyGaugeVec.WithLabelValues("max").Set(maximum.Seconds())
+	registry.MustRegister(receivedGaugeVec, missingGauge, duplicatedGauge, latencyGaugeVec)
+}
+
+// sessionMetrics registers the metrics of the queued messages of the session module.
+func sessionMetrics(registry *prometheus.Registry, queue *sessionQueue, constLabels prometheus.Labels) {
+	presentGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_session_present",
+		Help:        "Displays whether or not the session was present when the probe reconnected",
+		ConstLabels: constLabels,
+	})
+	if queue.sessionPresent() {
+		presentGauge.Set(1)
+	}
+	deliveredGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "emqx",
+		Subsystem:   "mqtt",
+		Name:        "probe_session_queued_delivered",
+		Help:        "Number of the messages queued while the probe was offline which were delivered after it reconnected",
+		ConstLabels: constLabels,
+	})
+	deliveredGauge.Set(float64(queue.deliveredMessages()))
+	registry.MustRegister(presentGauge, deliveredGauge)
+}
+
+// moduleProbe returns the probe of the named module for the target. The client ID and the topic are suffixed
+// with the hash of the target, so that the probes of the module to the nodes of one cluster don't interfere.
+func moduleProbe(module config.Probe, target string) config.Probe {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(target))
+	suffix := strconv.FormatUint(uint64(h.Sum32()), 16)
+	module.Target = target
+	module.ClientID += "-" + suffix
+	module.Topic += "/" + suffix
+	return module
+}
+
+// probeModule returns the module of the probe, pubsub if it isn't set.
+func probeModule(probe config.Probe) string {
+	if probe.Module == "" {
+		return config.ProbeModulePubSub
+	}
+	return probe.Module
+}
+
+// probeOnce probes the target by the module and the protocol version of the probe, it returns whether the probe
+// was a success and the trace of it. The probe which expects a rejection succeeds only if it's rejected. The probe
+// gives up once ctx is done, and its connections are closed when it returns.
+func probeOnce(ctx context.Context, probe config.Probe, logger log.Logger) (bool, *probeTrace) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	trace := newProbeTrace()
+	success := probeModuleOnce(ctx, probe, trace, logger)
+	if probe.Expect == "" {
+		return success, trace
+	}
+	if success {
+		level.Error(logger).Log("msg", "MQTT probe wasn't rejected as expected", "target", probe.Target, "expect", probe.Expect)
+		trace.fail(phaseExpect)
+		return false, trace
+	}
+	if !rejected(probe.Expect, trace) {
+		level.Error(logger).Log("msg", "MQTT probe failed other than the expected rejection", "target", probe.Target, "expect", probe.Expect, "phase", trace.failedPhase())
+		return false, trace
+	}
+	level.Debug(logger).Log("msg", "MQTT probe was rejected as expected", "target", probe.Target, "expect", probe.Expect)
+	return true, trace
+}
+
+// rejected returns whether the probe failed by the expected rejection, i.e. the failure return or reason code of
+// CONNACK or SUBACK. The publish is denied if the message isn't delivered, unless the broker acknowledged it
+// successfully, as MQTT 3 and QoS 0 have no failure codes of it.
+func rejected(expect string, trace *probeTrace) bool {
+	switch failed := trace.failedPhase(); expect {
+	case config.ProbeExpectConnectRefused:
+		code, ok := trace.reasonCode(packetConnack)
+		return failed == phaseConnack && ok && code != 0
+	case config.ProbeExpectSubscribeDenied:
+		code, ok := trace.reasonCode(packetSuback)
+		return failed == phaseSubscribe && ok && code >= 0x80
+	case config.ProbeExpectPublishDenied:
+		if code, ok := trace.reasonCode(packetPuback); ok && code < 0x80 {
+			return false
+		}
+		return failed == phasePublish || failed == phaseRoundtrip
+	}
+	return false
+}
+
+// probeModuleOnce probes the target by the module and the protocol version of the probe, and returns whether
+// the message was delivered.
+func probeModuleOnce(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	switch probe.Module {
+	case config.ProbeModuleRetained:
+		if probe.ProtocolVersion == 5 {
+			return probeRetained5(ctx, probe, trace, logger)
+		}
+		return probeRetained(ctx, probe, trace, logger)
+	case config.ProbeModuleWill:
+		if probe.ProtocolVersion == 5 {
+			return probeWill5(ctx, probe, trace, logger)
+		}
+		return probeWill(ctx, probe, trace, logger)
+	case config.ProbeModuleShared:
+		return probeShared(ctx, probe, trace, logger)
+	case config.ProbeModuleSession:
+		if probe.ProtocolVersion == 5 {
+			return probeSession5(ctx, probe, trace, logger)
+		}
+		return probeSession(ctx, probe, trace, logger)
+	}
+	if probe.ProtocolVersion == 5 {
+		mp := newMQTT5Probe(ctx, probe, trace, logger)
+		return mp != nil && mp.Probe(ctx, probe, logger)
+	}
+	mp := newMQTTProbe(ctx, probe, trace, logger)
+	return mp != nil && mp.Probe(ctx, probe, logger)
 }
@@ -0,0 +1,1434 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+	"emqx-exporter/prober/mqtttest"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runProbe serves the probe of the target by Handler and returns the parsed metrics.
+func runProbe(t *testing.T, probes []config.Probe, target string) map[string]*dto.MetricFamily {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler(rec, httptest.NewRequest(http.MethodGet, "/probe?target="+target, nil), probes, nil, log.NewNopLogger(), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d: %s", rec.Code, rec.Body.String())
+	}
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+// gaugeValues returns the values of the gauges keyed by the phase or stage label, the key is empty for the gauge
+// without them. It fails the test if any gauge isn't labelled by the target.
+func gaugeValues(t *testing.T, mf *dto.MetricFamily, target string) map[string]float64 {
+	t.Helper()
+	if mf.GetType() != dto.MetricType_GAUGE {
+		t.Fatalf("Expected %s to be a gauge", mf.GetName())
+	}
+	values := make(map[string]float64, len(mf.GetMetric()))
+	for _, m := range mf.GetMetric() {
+		var phase string
+		for _, label := range m.GetLabel() {
+			switch label.GetName() {
+			case "target":
+				if label.GetValue() != target {
+					t.Errorf("Expected %s to be labelled by target=%q but got %q", mf.GetName(), target, label.GetValue())
+				}
+			case "phase", "stage":
+				phase = label.GetValue()
+			case "publish_target", "subscribe_target", "module":
+				// The labels of the cross-node probe are checked by pairLabels, and the module by TestHandlerModules.
+			default:
+				t.Errorf("Unexpected label %s of %s", label.GetName(), mf.GetName())
+			}
+		}
+		values[phase] = m.GetGauge().GetValue()
+	}
+	return values
+}
+
+// pairLabels returns the publish_target and subscribe_target labels of the gauge, it fails the test
+// if the metrics of the gauge are labelled by different pairs.
+func pairLabels(t *testing.T, mf *dto.MetricFamily) (publishTarget, subscribeTarget string) {
+	t.Helper()
+	for i, m := range mf.GetMetric() {
+		var pub, sub string
+		for _, label := range m.GetLabel() {
+			switch label.GetName() {
+			case "publish_target":
+				pub = label.GetValue()
+			case "subscribe_target":
+				sub = label.GetValue()
+			}
+		}
+		if i > 0 && (pub != publishTarget || sub != subscribeTarget) {
+			t.Fatalf("Expected the metrics of %s to be labelled by the same pair", mf.GetName())
+		}
+		publishTarget, subscribeTarget = pub, sub
+	}
+	return publishTarget, subscribeTarget
+}
+
+// waitDisconnected fails the test if the clients of the probe are still connected to the broker.
+func waitDisconnected(t *testing.T, broker *mqtttest.Broker) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Connected() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the probe to disconnect, %d clients are still connected", broker.Connected())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name    string
+		scheme  string
+		modify  func(p *config.Probe)
+		inject  func(b *mqtttest.Broker)
+		success float64
+		// failedPhase is the phase expected to fail, none if the probe succeeds.
+		failedPhase string
+		// minDuration is the least duration of the probe, i.e. the timeout it waits for.
+		minDuration time.Duration
+	}{
+		{
+			name:    "tcp",
+			scheme:  "tcp",
+			success: 1,
+		},
+		{
+			name:    "tls",
+			scheme:  "ssl",
+			success: 1,
+		},
+		{
+			name:    "websocket",
+			scheme:  "ws",
+			success: 1,
+		},
+		{
+			name:    "qos 1",
+			scheme:  "tcp",
+			modify:  func(p *config.Probe) { p.QoS = 1 },
+			success: 1,
+		},
+		{
+			name:    "qos 2",
+			scheme:  "tcp",
+			modify:  func(p *config.Probe) { p.QoS = 2 },
+			success: 1,
+		},
+		{
+			name:        "connect refused",
+			scheme:      "tcp",
+			inject:      func(b *mqtttest.Broker) { b.RejectConnect() },
+			failedPhase: phaseConnack,
+		},
+		{
+			name:        "bad password",
+			scheme:      "tcp",
+			modify:      func(p *config.Probe) { p.Password = "wrong" },
+			failedPhase: phaseConnack,
+		},
+		{
+			name:        "connection refused",
+			scheme:      "tcp",
+			modify:      func(p *config.Probe) { p.Target = "127.0.0.1:1" },
+			failedPhase: phaseConnect,
+		},
+		{
+			name:        "subscribe denied",
+			scheme:      "tcp",
+			inject:      func(b *mqtttest.Broker) { b.DenySubscribe() },
+			failedPhase: phaseSubscribe,
+		},
+		{
+			name:        "publish timeout",
+			scheme:      "tcp",
+			modify:      func(p *config.Probe) { p.QoS = 1 },
+			inject:      func(b *mqtttest.Broker) { b.DropPublish() },
+			minDuration: time.Second,
+			failedPhase: phasePublish,
+		},
+		{
+			name:        "receive timeout",
+			scheme:      "tcp",
+			inject:      func(b *mqtttest.Broker) { b.DropPublish() },
+			minDuration: time.Second,
+			failedPhase: phaseRoundtrip,
+		},
+		{
+			name:        "payload mismatch",
+			scheme:      "tcp",
+			inject:      func(b *mqtttest.Broker) { b.ReplacePayload("unexpected") },
+			failedPhase: phaseRoundtrip,
+		},
+		{
+			name:        "tls handshake failure",
+			scheme:      "ssl",
+			modify:      func(p *config.Probe) { p.TLSClientConfig = &config.TLSClientConfig{} },
+			failedPhase: phaseTLS,
+		},
+		{
+			name:        "tls to tcp listener",
+			scheme:      "ssl",
+			modify:      func(p *config.Probe) { p.Target = broker.Target("tcp") },
+			failedPhase: phaseTLS,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer broker.Reset()
+			probe := broker.Probe(tc.scheme)
+			if tc.modify != nil {
+				tc.modify(&probe)
+			}
+			if tc.inject != nil {
+				tc.inject(broker)
+			}
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+			names := make([]string, 0, len(mfs))
+			for name := range mfs {
+				// The return codes are checked by TestHandlerExpect, the TLS metrics by TestHandlerTLS,
+				// and the status code of the websocket handshake by TestHandlerWebsocket.
+				if !strings.HasSuffix(name, "_reason_code") && !strings.HasPrefix(name, "emqx_tls_") &&
+					name != "emqx_mqtt_probe_ws_handshake_status_code" {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			expectedNames := []string{
+				"emqx_mqtt_probe_duration_seconds",
+				"emqx_mqtt_probe_failed_phase",
+				"emqx_mqtt_probe_phase_duration_seconds",
+				"emqx_mqtt_probe_success",
+			}
+			if probe.QoS > 0 {
+				expectedNames = append([]string{
+					"emqx_mqtt_probe_ack_duration_seconds",
+					"emqx_mqtt_probe_dup_received",
+				}, expectedNames...)
+			}
+			if strings.Join(names, ",") != strings.Join(expectedNames, ",") {
+				t.Fatalf("Expected metrics %v but got %v", expectedNames, names)
+			}
+
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			duration := gaugeValues(t, mfs["emqx_mqtt_probe_duration_seconds"], probe.Target)[""]
+			if duration <= 0 || duration < tc.minDuration.Seconds() {
+				t.Errorf("Expected emqx_mqtt_probe_duration_seconds to be at least %s but got %v", tc.minDuration, duration)
+			}
+
+			failedPhases := gaugeValues(t, mfs["emqx_mqtt_probe_failed_phase"], probe.Target)
+			phaseDurations := gaugeValues(t, mfs["emqx_mqtt_probe_phase_duration_seconds"], probe.Target)
+			if len(failedPhases) != len(probePhases) || len(phaseDurations) != len(probePhases) {
+				t.Fatalf("Expected the metrics of all phases %v, got %v and %v", probePhases, failedPhases, phaseDurations)
+			}
+			reached := true
+			for _, phase := range probePhases {
+				expected := 0.0
+				if phase == tc.failedPhase {
+					expected = 1
+				}
+				if failedPhases[phase] != expected {
+					t.Errorf("Expected emqx_mqtt_probe_failed_phase{phase=%q} %v but got %v", phase, expected, failedPhases[phase])
+				}
+				if !reached && phaseDurations[phase] != 0 {
+					t.Errorf("Expected the phase %s after the failed phase not to be reached but it took %vs", phase, phaseDurations[phase])
+				}
+				if phase == tc.failedPhase {
+					if phaseDurations[phase] <= 0 {
+						t.Errorf("Expected the duration of the failed phase %s but got %v", phase, phaseDurations[phase])
+					}
+					reached = false
+				}
+			}
+			if tc.success == 1 {
+				for _, phase := range []string{phaseConnect, phaseConnack, phaseSubscribe, phasePublish, phaseRoundtrip} {
+					if phaseDurations[phase] <= 0 {
+						t.Errorf("Expected the duration of the phase %s but got %v", phase, phaseDurations[phase])
+					}
+				}
+				if tls := phaseDurations[phaseTLS]; (probe.Scheme == "ssl") != (tls > 0) {
+					t.Errorf("Unexpected duration of the phase tls %v for the scheme %s", tls, probe.Scheme)
+				}
+				if probe.QoS > 0 {
+					ackDurations := gaugeValues(t, mfs["emqx_mqtt_probe_ack_duration_seconds"], probe.Target)
+					for _, stage := range ackStages(probe.QoS) {
+						if ackDurations[stage] <= 0 {
+							t.Errorf("Expected the duration of the stage %s but got %v", stage, ackDurations[stage])
+						}
+					}
+					if len(ackDurations) != len(ackStages(probe.QoS)) {
+						t.Errorf("Expected the stages %v of QoS %d but got %v", ackStages(probe.QoS), probe.QoS, ackDurations)
+					}
+					if dups := gaugeValues(t, mfs["emqx_mqtt_probe_dup_received"], probe.Target)[""]; dups != 0 {
+						t.Errorf("Expected no DUP received but got %v", dups)
+					}
+				}
+			}
+
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerUnknownTarget(t *testing.T) {
+	rec := httptest.NewRecorder()
+	probes := []config.Probe{{Target: "127.0.0.1:1883"}}
+	Handler(rec, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1:1884", nil), probes, nil, log.NewNopLogger(), nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 but got %d", rec.Code)
+	}
+}
+
+func TestHandlerUnknownModule(t *testing.T) {
+	rec := httptest.NewRecorder()
+	probes := []config.Probe{{Target: "127.0.0.1:1883"}, {Target: "127.0.0.1:1883", Module: config.ProbeModuleWill}}
+	Handler(rec, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1:1883&module=retained", nil), probes, nil, log.NewNopLogger(), nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 but got %d", rec.Code)
+	}
+}
+
+func TestHandlerNamedModules(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	qos1 := broker.Probe("tcp")
+	qos1.Target, qos1.QoS = "", 1
+	retained := broker.Probe("ssl")
+	retained.Target, retained.Module = "", config.ProbeModuleRetained
+	modules := map[string]config.Probe{"mqtt_qos1": qos1, "mqtts_retained": retained}
+	// The configured probe of the target isn't taken by the named module.
+	probes := []config.Probe{{Target: broker.Target("tcp"), Module: config.ProbeModuleWill}}
+
+	testcases := []struct {
+		name   string
+		query  string
+		target string
+		code   int
+		// label is the expected module label, the probe of the module isn't labelled by it unless it's set.
+		label string
+	}{
+		{
+			name:   "pubsub",
+			query:  "module=mqtt_qos1&target=" + broker.Target("tcp"),
+			target: broker.Target("tcp"),
+			code:   http.StatusOK,
+		},
+		{
+			name:   "retained over tls",
+			query:  "module=mqtts_retained&target=" + broker.Target("ssl"),
+			target: broker.Target("ssl"),
+			code:   http.StatusOK,
+			label:  config.ProbeModuleRetained,
+		},
+		{
+			name:  "missing target",
+			query: "module=mqtt_qos1",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "unknown module",
+			query: "module=mqtt_qos2&target=" + broker.Target("tcp"),
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Handler(rec, httptest.NewRequest(http.MethodGet, "/probe?"+tc.query, nil), probes, modules, log.NewNopLogger(), nil)
+			if rec.Code != tc.code {
+				t.Fatalf("Expected status %d but got %d: %s", tc.code, rec.Code, rec.Body.String())
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			var parser expfmt.TextParser
+			mfs, err := parser.TextToMetricFamilies(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mf := mfs["emqx_mqtt_probe_success"]
+			if got := gaugeValues(t, mf, tc.target)[""]; got != 1 {
+				t.Errorf("Expected emqx_mqtt_probe_success 1 but got %v", got)
+			}
+			var label string
+			for _, l := range mf.GetMetric()[0].GetLabel() {
+				if l.GetName() == "module" {
+					label = l.GetValue()
+				}
+			}
+			if label != tc.label {
+				t.Errorf("Expected the module label %q but got %q", tc.label, label)
+			}
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestModuleProbe(t *testing.T) {
+	module := config.Probe{ClientID: "emqx-exporter-probe-mqtt", Topic: "emqx-exporter-probe/mqtt"}
+	a, b := moduleProbe(module, "emqx-0.emqx:1883"), moduleProbe(module, "emqx-1.emqx:1883")
+	if a.Target != "emqx-0.emqx:1883" || b.Target != "emqx-1.emqx:1883" {
+		t.Errorf("Expected the targets of the probes but got %s and %s", a.Target, b.Target)
+	}
+	if a.ClientID == b.ClientID || a.Topic == b.Topic {
+		t.Errorf("Expected the probes of different targets to have different client IDs and topics but got %+v and %+v", a, b)
+	}
+	if again := moduleProbe(module, "emqx-0.emqx:1883"); again.ClientID != a.ClientID || again.Topic != a.Topic {
+		t.Errorf("Expected the client ID and topic of the target to be stable")
+	}
+}
+
+func TestHandlerMQTT5(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name        string
+		scheme      string
+		modify      func(p *config.Probe)
+		inject      func(b *mqtttest.Broker)
+		success     float64
+		failedPhase string
+		// reasonCodes are the expected reason codes keyed by the packet, the packets which aren't received are absent.
+		reasonCodes map[string]float64
+	}{
+		{
+			name:        "tcp",
+			scheme:      "tcp",
+			success:     1,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0},
+		},
+		{
+			name:        "tls",
+			scheme:      "ssl",
+			modify:      func(p *config.Probe) { p.QoS = 1 },
+			success:     1,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 1, packetPuback: 0},
+		},
+		{
+			name:   "websocket with properties",
+			scheme: "ws",
+			modify: func(p *config.Probe) {
+				p.QoS = 2
+				p.UserProperties = map[string]string{"from": "emqx-exporter", "probe": "test"}
+				p.TopicAlias = 1
+			},
+			success:     1,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 2, packetPuback: 0},
+		},
+		{
+			name:   "session expiry",
+			scheme: "tcp",
+			modify: func(p *config.Probe) {
+				p.QoS = 2
+				p.SessionExpiryInterval = 60
+			},
+			success:     1,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 2, packetPuback: 0},
+		},
+		{
+			name:        "connect refused",
+			scheme:      "tcp",
+			inject:      func(b *mqtttest.Broker) { b.RejectConnect() },
+			failedPhase: phaseConnack,
+			reasonCodes: map[string]float64{packetConnack: 0x86},
+		},
+		{
+			name:        "subscribe denied",
+			scheme:      "tcp",
+			inject:      func(b *mqtttest.Broker) { b.DenySubscribe() },
+			failedPhase: phaseSubscribe,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0x87},
+		},
+		{
+			name:        "publish denied",
+			scheme:      "tcp",
+			modify:      func(p *config.Probe) { p.QoS = 1 },
+			inject:      func(b *mqtttest.Broker) { b.DenyPublish() },
+			failedPhase: phasePublish,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 1, packetPuback: 0x87},
+		},
+		{
+			name:        "publish denied qos 2",
+			scheme:      "tcp",
+			modify:      func(p *config.Probe) { p.QoS = 2 },
+			inject:      func(b *mqtttest.Broker) { b.DenyPublish() },
+			failedPhase: phasePublish,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 2, packetPuback: 0x87},
+		},
+		{
+			name:        "topic alias exceeds the maximum",
+			scheme:      "tcp",
+			modify:      func(p *config.Probe) { p.TopicAlias = 11 },
+			inject:      func(b *mqtttest.Broker) { b.SetTopicAliasMaximum(10) },
+			failedPhase: phasePublish,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0},
+		},
+		{
+			name:   "user properties dropped",
+			scheme: "tcp",
+			modify: func(p *config.Probe) {
+				p.UserProperties = map[string]string{"from": "emqx-exporter"}
+			},
+			inject:      func(b *mqtttest.Broker) { b.DropUserProperties() },
+			failedPhase: phaseRoundtrip,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0},
+		},
+		{
+			name:        "tls handshake failure",
+			scheme:      "ssl",
+			modify:      func(p *config.Probe) { p.TLSClientConfig = &config.TLSClientConfig{} },
+			failedPhase: phaseTLS,
+			reasonCodes: map[string]float64{},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer broker.Reset()
+			probe := broker.Probe(tc.scheme)
+			probe.ProtocolVersion = 5
+			if tc.modify != nil {
+				tc.modify(&probe)
+			}
+			if tc.inject != nil {
+				tc.inject(broker)
+			}
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			failedPhases := gaugeValues(t, mfs["emqx_mqtt_probe_failed_phase"], probe.Target)
+			for _, phase := range probePhases {
+				expected := 0.0
+				if phase == tc.failedPhase {
+					expected = 1
+				}
+				if failedPhases[phase] != expected {
+					t.Errorf("Expected emqx_mqtt_probe_failed_phase{phase=%q} %v but got %v", phase, expected, failedPhases[phase])
+				}
+			}
+			for _, packet := range reasonCodePackets {
+				name := "emqx_mqtt_probe_" + packet + "_reason_code"
+				expected, ok := tc.reasonCodes[packet]
+				mf, found := mfs[name]
+				if !ok {
+					if found {
+						t.Errorf("Expected no %s but got %v", name, mf)
+					}
+					continue
+				}
+				if !found {
+					t.Errorf("Expected %s %v but got none", name, expected)
+					continue
+				}
+				if got := gaugeValues(t, mf, probe.Target)[""]; got != expected {
+					t.Errorf("Expected %s %v but got %v", name, expected, got)
+				}
+			}
+
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerCrossNode(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name            string
+		protocolVersion uint
+		publishTarget   string
+		subscribeTarget string
+		success         float64
+		failedPhase     string
+	}{
+		{
+			name:            "tcp to websocket",
+			publishTarget:   broker.Target("tcp"),
+			subscribeTarget: "ws://" + broker.Target("ws"),
+			success:         1,
+		},
+		{
+			name:            "websocket to tcp",
+			publishTarget:   "ws://" + broker.Target("ws"),
+			subscribeTarget: broker.Target("tcp"),
+			success:         1,
+		},
+		{
+			name:            "mqtt 5 tcp to websocket",
+			protocolVersion: 5,
+			publishTarget:   broker.Target("tcp"),
+			subscribeTarget: "ws://" + broker.Target("ws"),
+			success:         1,
+		},
+		{
+			name:            "publish target down",
+			publishTarget:   "127.0.0.1:1",
+			subscribeTarget: broker.Target("tcp"),
+			failedPhase:     phaseConnect,
+		},
+		{
+			name:            "subscribe target down",
+			publishTarget:   broker.Target("tcp"),
+			subscribeTarget: "127.0.0.1:1",
+			failedPhase:     phaseConnect,
+		},
+		{
+			name:            "mqtt 5 publish target down",
+			protocolVersion: 5,
+			publishTarget:   "127.0.0.1:1",
+			subscribeTarget: broker.Target("tcp"),
+			failedPhase:     phaseConnect,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			probe := broker.Probe("tcp")
+			probe.Target = "cross-node"
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.PublishTarget = tc.publishTarget
+			probe.SubscribeTarget = tc.subscribeTarget
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+			for name, mf := range mfs {
+				if pub, sub := pairLabels(t, mf); pub != tc.publishTarget || sub != tc.subscribeTarget {
+					t.Errorf("Expected %s to be labelled by the pair %s, %s but got %s, %s", name, tc.publishTarget, tc.subscribeTarget, pub, sub)
+				}
+			}
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			failedPhases := gaugeValues(t, mfs["emqx_mqtt_probe_failed_phase"], probe.Target)
+			for _, phase := range probePhases {
+				expected := 0.0
+				if phase == tc.failedPhase {
+					expected = 1
+				}
+				if failedPhases[phase] != expected {
+					t.Errorf("Expected emqx_mqtt_probe_failed_phase{phase=%q} %v but got %v", phase, expected, failedPhases[phase])
+				}
+			}
+			if tc.success == 1 {
+				if roundtrip := gaugeValues(t, mfs["emqx_mqtt_probe_phase_duration_seconds"], probe.Target)[phaseRoundtrip]; roundtrip <= 0 {
+					t.Errorf("Expected the duration of the phase roundtrip across the nodes but got %v", roundtrip)
+				}
+			}
+
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerQoSLevels(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	probe := broker.Probe("tcp")
+	probe.QoSLevels = []int{0, 1, 2}
+	mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+	// values returns the values of the metric keyed by the qos label and the phase or stage label.
+	values := func(name string) map[string]float64 {
+		values := make(map[string]float64)
+		for _, m := range mfs[name].GetMetric() {
+			var qos, phase string
+			for _, label := range m.GetLabel() {
+				switch label.GetName() {
+				case "qos":
+					qos = label.GetValue()
+				case "phase", "stage":
+					phase = label.GetValue()
+				}
+			}
+			values[qos+"/"+phase] = m.GetGauge().GetValue()
+		}
+		return values
+	}
+
+	success := values("emqx_mqtt_probe_success")
+	if len(success) != 3 || success["0/"] != 1 || success["1/"] != 1 || success["2/"] != 1 {
+		t.Errorf("Expected the success of all QoS levels but got %v", success)
+	}
+	ackDurations := values("emqx_mqtt_probe_ack_duration_seconds")
+	if len(ackDurations) != 3 || ackDurations["1/puback"] <= 0 || ackDurations["2/pubrec"] <= 0 || ackDurations["2/pubcomp"] <= 0 {
+		t.Errorf("Expected the ack durations of QoS 1 and 2 but got %v", ackDurations)
+	}
+	if dups := values("emqx_mqtt_probe_dup_received"); len(dups) != 2 {
+		t.Errorf("Expected the DUP received of QoS 1 and 2 but got %v", dups)
+	}
+	waitDisconnected(t, broker)
+}
+
+func TestHandlerModules(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name            string
+		module          string
+		protocolVersion uint
+		qos             byte
+		crossNode       bool
+		inject          func(b *mqtttest.Broker)
+		success         float64
+		failedPhase     string
+	}{
+		{
+			name:    "retained",
+			module:  config.ProbeModuleRetained,
+			success: 1,
+		},
+		{
+			name:    "retained qos 1",
+			module:  config.ProbeModuleRetained,
+			qos:     1,
+			success: 1,
+		},
+		{
+			name:            "mqtt 5 retained",
+			module:          config.ProbeModuleRetained,
+			protocolVersion: 5,
+			success:         1,
+		},
+		{
+			name:      "retained across nodes",
+			module:    config.ProbeModuleRetained,
+			crossNode: true,
+			success:   1,
+		},
+		{
+			name:        "retained message dropped",
+			module:      config.ProbeModuleRetained,
+			inject:      func(b *mqtttest.Broker) { b.DropPublish() },
+			failedPhase: phaseRoundtrip,
+		},
+		{
+			name:            "mqtt 5 retained publish denied",
+			module:          config.ProbeModuleRetained,
+			protocolVersion: 5,
+			qos:             1,
+			inject:          func(b *mqtttest.Broker) { b.DenyPublish() },
+			failedPhase:     phasePublish,
+		},
+		{
+			name:    "will",
+			module:  config.ProbeModuleWill,
+			success: 1,
+		},
+		{
+			name:    "will qos 1",
+			module:  config.ProbeModuleWill,
+			qos:     1,
+			success: 1,
+		},
+		{
+			name:            "mqtt 5 will",
+			module:          config.ProbeModuleWill,
+			protocolVersion: 5,
+			success:         1,
+		},
+		{
+			name:      "will across nodes",
+			module:    config.ProbeModuleWill,
+			crossNode: true,
+			success:   1,
+		},
+		{
+			name:        "will subscribe denied",
+			module:      config.ProbeModuleWill,
+			inject:      func(b *mqtttest.Broker) { b.DenySubscribe() },
+			failedPhase: phaseSubscribe,
+		},
+		{
+			name:            "mqtt 5 will dropped",
+			module:          config.ProbeModuleWill,
+			protocolVersion: 5,
+			inject:          func(b *mqtttest.Broker) { b.DropPublish() },
+			failedPhase:     phaseRoundtrip,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker.Reset()
+			if tc.inject != nil {
+				tc.inject(broker)
+			}
+			probe := broker.Probe("tcp")
+			probe.Module = tc.module
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.QoS = tc.qos
+			if tc.crossNode {
+				probe.Target = "cross-node"
+				probe.PublishTarget = broker.Target("tcp")
+				probe.SubscribeTarget = "ws://" + broker.Target("ws")
+			}
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+			for name, mf := range mfs {
+				for _, m := range mf.GetMetric() {
+					var module string
+					for _, label := range m.GetLabel() {
+						if label.GetName() == "module" {
+							module = label.GetValue()
+						}
+					}
+					if module != tc.module {
+						t.Errorf("Expected %s to be labelled by module=%q but got %q", name, tc.module, module)
+					}
+				}
+			}
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			failedPhases := gaugeValues(t, mfs["emqx_mqtt_probe_failed_phase"], probe.Target)
+			for _, phase := range probePhases {
+				expected := 0.0
+				if phase == tc.failedPhase {
+					expected = 1
+				}
+				if failedPhases[phase] != expected {
+					t.Errorf("Expected emqx_mqtt_probe_failed_phase{phase=%q} %v but got %v", phase, expected, failedPhases[phase])
+				}
+			}
+			if tc.success == 1 {
+				if roundtrip := gaugeValues(t, mfs["emqx_mqtt_probe_phase_duration_seconds"], probe.Target)[phaseRoundtrip]; roundtrip <= 0 {
+					t.Errorf("Expected the duration of the phase roundtrip but got %v", roundtrip)
+				}
+			}
+
+			broker.Reset()
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerShared(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name            string
+		protocolVersion uint
+		qos             byte
+		inject          func(b *mqtttest.Broker)
+		success         float64
+		failedPhase     string
+		missing         float64
+	}{
+		{
+			name:    "tcp",
+			success: 1,
+		},
+		{
+			name:    "qos 1",
+			qos:     1,
+			success: 1,
+		},
+		{
+			name:            "mqtt 5",
+			protocolVersion: 5,
+			success:         1,
+		},
+		{
+			name:        "messages dropped",
+			inject:      func(b *mqtttest.Broker) { b.DropPublish() },
+			failedPhase: phaseRoundtrip,
+			missing:     5,
+		},
+		{
+			name:        "subscribe denied",
+			inject:      func(b *mqtttest.Broker) { b.DenySubscribe() },
+			failedPhase: phaseSubscribe,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker.Reset()
+			if tc.inject != nil {
+				tc.inject(broker)
+			}
+			probe := broker.Probe("tcp")
+			probe.Module = config.ProbeModuleShared
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.QoS = tc.qos
+			probe.SharedGroup = "exporter"
+			probe.SharedSubscribers = 3
+			probe.SharedMessages = 5
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			if failed := gaugeValues(t, mfs["emqx_mqtt_probe_failed_phase"], probe.Target); tc.failedPhase != "" && failed[tc.failedPhase] != 1 {
+				t.Errorf("Expected the phase %s to fail but got %v", tc.failedPhase, failed)
+			}
+			if tc.failedPhase == phaseSubscribe {
+				waitDisconnected(t, broker)
+				return
+			}
+
+			var received float64
+			for _, m := range mfs["emqx_mqtt_probe_shared_received"].GetMetric() {
+				received += m.GetGauge().GetValue()
+			}
+			if subscribers := len(mfs["emqx_mqtt_probe_shared_received"].GetMetric()); subscribers != probe.SharedSubscribers {
+				t.Errorf("Expected the messages received by %d subscribers but got %d", probe.SharedSubscribers, subscribers)
+			}
+			if expected := float64(probe.SharedMessages) - tc.missing; received != expected {
+				t.Errorf("Expected %v messages received by the shared group but got %v", expected, received)
+			}
+			if missing := gaugeValues(t, mfs["emqx_mqtt_probe_shared_missing"], probe.Target)[""]; missing != tc.missing {
+				t.Errorf("Expected emqx_mqtt_probe_shared_missing %v but got %v", tc.missing, missing)
+			}
+			if duplicated := gaugeValues(t, mfs["emqx_mqtt_probe_shared_duplicated"], probe.Target)[""]; duplicated != 0 {
+				t.Errorf("Expected emqx_mqtt_probe_shared_duplicated 0 but got %v", duplicated)
+			}
+			for _, m := range mfs["emqx_mqtt_probe_shared_latency_seconds"].GetMetric() {
+				if latency := m.GetGauge().GetValue(); (tc.success == 1) != (latency > 0) {
+					t.Errorf("Unexpected latency %v of %v", latency, m.GetLabel())
+				}
+			}
+
+			broker.Reset()
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerSession(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name            string
+		protocolVersion uint
+		resumeTarget    string
+		inject          func(b *mqtttest.Broker)
+		success         float64
+		failedPhase     string
+		present         float64
+		delivered       float64
+	}{
+		{
+			name:      "tcp",
+			success:   1,
+			present:   1,
+			delivered: 3,
+		},
+		{
+			name:            "mqtt 5",
+			protocolVersion: 5,
+			success:         1,
+			present:         1,
+			delivered:       3,
+		},
+		{
+			name:         "resume on websocket",
+			resumeTarget: "ws://" + broker.Target("ws"),
+			success:      1,
+			present:      1,
+			delivered:    3,
+		},
+		{
+			name:        "messages dropped",
+			inject:      func(b *mqtttest.Broker) { b.DropPublish() },
+			failedPhase: phasePublish,
+		},
+		{
+			name:         "resume target down",
+			resumeTarget: "127.0.0.1:1",
+			failedPhase:  phaseConnect,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker.Reset()
+			if tc.inject != nil {
+				tc.inject(broker)
+			}
+			probe := broker.Probe("tcp")
+			probe.Module = config.ProbeModuleSession
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.QoS = 1
+			probe.SessionMessages = 3
+			probe.ResumeTarget = tc.resumeTarget
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			if failed := gaugeValues(t, mfs["emqx_mqtt_probe_failed_phase"], probe.Target); tc.failedPhase != "" && failed[tc.failedPhase] != 1 {
+				t.Errorf("Expected the phase %s to fail but got %v", tc.failedPhase, failed)
+			}
+			if present := gaugeValues(t, mfs["emqx_mqtt_probe_session_present"], probe.Target)[""]; present != tc.present {
+				t.Errorf("Expected emqx_mqtt_probe_session_present %v but got %v", tc.present, present)
+			}
+			if delivered := gaugeValues(t, mfs["emqx_mqtt_probe_session_queued_delivered"], probe.Target)[""]; delivered != tc.delivered {
+				t.Errorf("Expected emqx_mqtt_probe_session_queued_delivered %v but got %v", tc.delivered, delivered)
+			}
+			if tc.success == 1 {
+				if roundtrip := gaugeValues(t, mfs["emqx_mqtt_probe_phase_duration_seconds"], probe.Target)[phaseRoundtrip]; roundtrip <= 0 {
+					t.Errorf("Expected the duration of the phase roundtrip but got %v", roundtrip)
+				}
+			}
+
+			broker.Reset()
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerExpect(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name            string
+		protocolVersion uint
+		qos             byte
+		expect          string
+		modify          func(p *config.Probe)
+		inject          func(b *mqtttest.Broker)
+		success         float64
+		reasonCodes     map[string]float64
+	}{
+		{
+			name:        "connect refused",
+			expect:      config.ProbeExpectConnectRefused,
+			modify:      func(p *config.Probe) { p.Password = "wrong" },
+			success:     1,
+			reasonCodes: map[string]float64{packetConnack: 0x05},
+		},
+		{
+			name:            "mqtt 5 connect refused",
+			protocolVersion: 5,
+			expect:          config.ProbeExpectConnectRefused,
+			modify:          func(p *config.Probe) { p.Password = "wrong" },
+			success:         1,
+			reasonCodes:     map[string]float64{packetConnack: 0x86},
+		},
+		{
+			name:        "connect accepted",
+			expect:      config.ProbeExpectConnectRefused,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0},
+		},
+		{
+			name:    "connect failed by the network",
+			expect:  config.ProbeExpectConnectRefused,
+			modify:  func(p *config.Probe) { p.Target = "127.0.0.1:1" },
+			success: 0,
+		},
+		{
+			name:        "subscribe denied",
+			expect:      config.ProbeExpectSubscribeDenied,
+			inject:      func(b *mqtttest.Broker) { b.DenySubscribe() },
+			success:     1,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0x80},
+		},
+		{
+			name:            "mqtt 5 subscribe denied",
+			protocolVersion: 5,
+			expect:          config.ProbeExpectSubscribeDenied,
+			inject:          func(b *mqtttest.Broker) { b.DenySubscribe() },
+			success:         1,
+			reasonCodes:     map[string]float64{packetConnack: 0, packetSuback: 0x87},
+		},
+		{
+			name:        "subscribe allowed",
+			expect:      config.ProbeExpectSubscribeDenied,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0},
+		},
+		{
+			name:        "publish denied",
+			expect:      config.ProbeExpectPublishDenied,
+			inject:      func(b *mqtttest.Broker) { b.DenyPublish() },
+			success:     1,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0},
+		},
+		{
+			name:            "mqtt 5 publish denied",
+			protocolVersion: 5,
+			qos:             1,
+			expect:          config.ProbeExpectPublishDenied,
+			inject:          func(b *mqtttest.Broker) { b.DenyPublish() },
+			success:         1,
+			reasonCodes:     map[string]float64{packetConnack: 0, packetSuback: 1, packetPuback: 0x87},
+		},
+		{
+			name:        "publish allowed",
+			expect:      config.ProbeExpectPublishDenied,
+			reasonCodes: map[string]float64{packetConnack: 0, packetSuback: 0},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker.Reset()
+			if tc.inject != nil {
+				tc.inject(broker)
+			}
+			probe := broker.Probe("tcp")
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.QoS = tc.qos
+			probe.Expect = tc.expect
+			if tc.modify != nil {
+				tc.modify(&probe)
+			}
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			for _, packet := range reasonCodePackets {
+				name := "emqx_mqtt_probe_" + packet + "_reason_code"
+				expected, ok := tc.reasonCodes[packet]
+				mf, found := mfs[name]
+				if ok != found {
+					t.Errorf("Expected %s %v but got %v", name, tc.reasonCodes, mf)
+					continue
+				}
+				if !found {
+					continue
+				}
+				if got := gaugeValues(t, mf, probe.Target)[""]; got != expected {
+					t.Errorf("Expected %s %v but got %v", name, expected, got)
+				}
+			}
+
+			broker.Reset()
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerExpectWithinDeadline(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name            string
+		protocolVersion uint
+		qos             byte
+	}{
+		{name: "roundtrip"},
+		{name: "mqtt 5 publish", protocolVersion: 5, qos: 1},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker.Reset()
+			broker.DropPublish()
+			// The dropped message would be waited for the keep alive, which is longer than the deadline of the request.
+			probe := broker.Probe("tcp")
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.QoS = tc.qos
+			probe.KeepAlive = 600
+			probe.Expect = config.ProbeExpectPublishDenied
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			req := httptest.NewRequest(http.MethodGet, "/probe?target="+probe.Target, nil).WithContext(ctx)
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			Handler(rec, req, []config.Probe{probe}, nil, log.NewNopLogger(), nil)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Expected the probe to give up by the deadline but it took %s", elapsed)
+			}
+			var parser expfmt.TextParser
+			mfs, err := parser.TextToMetricFamilies(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != 1 {
+				t.Errorf("Expected the dropped message to be taken as denied but got emqx_mqtt_probe_success %v", got)
+			}
+
+			broker.Reset()
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerTLS(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	testcases := []struct {
+		name            string
+		scheme          string
+		protocolVersion uint
+		modify          func(p *config.Probe)
+		success         float64
+		// verified is the expected emqx_tls_chain_verified, the TLS metrics are expected to be absent if it's negative.
+		verified float64
+	}{
+		{
+			name:     "verified",
+			scheme:   "ssl",
+			success:  1,
+			verified: 1,
+		},
+		{
+			name:            "mqtt 5 verified",
+			scheme:          "ssl",
+			protocolVersion: 5,
+			success:         1,
+			verified:        1,
+		},
+		{
+			name:     "unknown ca",
+			scheme:   "ssl",
+			modify:   func(p *config.Probe) { p.TLSClientConfig = &config.TLSClientConfig{} },
+			verified: 0,
+		},
+		{
+			name:     "insecure skip verify",
+			scheme:   "ssl",
+			modify:   func(p *config.Probe) { p.TLSClientConfig = &config.TLSClientConfig{InsecureSkipVerify: true} },
+			success:  1,
+			verified: 0,
+		},
+		{
+			name:     "tcp",
+			scheme:   "tcp",
+			success:  1,
+			verified: -1,
+		},
+		{
+			name:     "tls to tcp listener",
+			scheme:   "ssl",
+			modify:   func(p *config.Probe) { p.Target = broker.Target("tcp") },
+			verified: -1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			probe := broker.Probe(tc.scheme)
+			probe.ProtocolVersion = tc.protocolVersion
+			if tc.modify != nil {
+				tc.modify(&probe)
+			}
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+
+			names := []string{
+				"emqx_tls_cert_info",
+				"emqx_tls_cert_not_after_seconds",
+				"emqx_tls_chain_verified",
+				"emqx_tls_cipher_info",
+				"emqx_tls_version_info",
+			}
+			if tc.verified < 0 {
+				for _, name := range names {
+					if _, ok := mfs[name]; ok {
+						t.Errorf("Unexpected %s of the probe without TLS handshake", name)
+					}
+				}
+				return
+			}
+			labels := make(map[string]map[string]string, len(names))
+			for _, name := range names {
+				mf, ok := mfs[name]
+				if !ok || len(mf.GetMetric()) == 0 {
+					t.Fatalf("Expected the metrics of %s", name)
+				}
+				labels[name] = make(map[string]string)
+				for _, label := range mf.GetMetric()[0].GetLabel() {
+					labels[name][label.GetName()] = label.GetValue()
+				}
+				if labels[name]["target"] != probe.Target || labels[name]["server_name"] != "127.0.0.1" {
+					t.Errorf("Expected %s to be labelled by the target and the server name but got %v", name, labels[name])
+				}
+			}
+
+			if got := mfs["emqx_tls_chain_verified"].GetMetric()[0].GetGauge().GetValue(); got != tc.verified {
+				t.Errorf("Expected emqx_tls_chain_verified %v but got %v", tc.verified, got)
+			}
+			// The test broker presents the server certificate and the CA.
+			if chain := mfs["emqx_tls_cert_not_after_seconds"].GetMetric(); len(chain) != 2 {
+				t.Errorf("Expected the expiration of 2 certificates but got %d", len(chain))
+			}
+			for _, m := range mfs["emqx_tls_cert_not_after_seconds"].GetMetric() {
+				if expiry := time.Unix(int64(m.GetGauge().GetValue()), 0); expiry.Before(time.Now()) {
+					t.Errorf("Expected the certificate to expire in the future but got %s", expiry)
+				}
+			}
+			info := labels["emqx_tls_cert_info"]
+			if info["subject"] != "CN=localhost" || info["issuer"] != "CN=emqx-exporter test CA" || !strings.Contains(info["san"], "127.0.0.1") {
+				t.Errorf("Unexpected emqx_tls_cert_info labels %v", info)
+			}
+			if version := labels["emqx_tls_version_info"]["version"]; version != "TLS 1.3" {
+				t.Errorf("Expected the version TLS 1.3 but got %q", version)
+			}
+			if cipher := labels["emqx_tls_cipher_info"]["cipher"]; !strings.HasPrefix(cipher, "TLS_") {
+				t.Errorf("Unexpected cipher %q", cipher)
+			}
+			waitDisconnected(t, broker)
+		})
+	}
+}
+
+func TestHandlerWebsocket(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	gateway := mqtttest.NewGateway(broker, "/mqtt", http.Header{"Authorization": []string{"Bearer token"}})
+	defer gateway.Close()
+
+	testcases := []struct {
+		name            string
+		protocolVersion uint
+		modify          func(p *config.Probe)
+		success         float64
+		failedPhase     string
+		status          float64
+		// tunneled is whether the handshake is expected to be tunneled by the gateway as the proxy.
+		tunneled bool
+	}{
+		{
+			name:    "path and headers",
+			success: 1,
+			status:  101,
+		},
+		{
+			name:            "mqtt 5 path and headers",
+			protocolVersion: 5,
+			success:         1,
+			status:          101,
+		},
+		{
+			name: "path of the target",
+			modify: func(p *config.Probe) {
+				p.Target = "ws://" + gateway.Target() + "/mqtt"
+				p.WSPath = "/other"
+			},
+			success: 1,
+			status:  101,
+		},
+		{
+			name:        "missing headers",
+			modify:      func(p *config.Probe) { p.WSHeaders = nil },
+			failedPhase: phaseConnect,
+			status:      401,
+		},
+		{
+			name:            "mqtt 5 missing headers",
+			protocolVersion: 5,
+			modify:          func(p *config.Probe) { p.WSHeaders = nil },
+			failedPhase:     phaseConnect,
+			status:          401,
+		},
+		{
+			name:        "wrong path",
+			modify:      func(p *config.Probe) { p.WSPath = "/other" },
+			failedPhase: phaseConnect,
+			status:      404,
+		},
+		{
+			name: "proxy",
+			modify: func(p *config.Probe) {
+				p.Target = broker.Target("ws")
+				p.ProxyURL = config.SecretURL("http://" + gateway.Target())
+			},
+			success:  1,
+			status:   101,
+			tunneled: true,
+		},
+		{
+			name:        "unreachable proxy",
+			modify:      func(p *config.Probe) { p.ProxyURL = "http://127.0.0.1:1" },
+			failedPhase: phaseConnect,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			probe := broker.Probe("ws")
+			probe.Target = gateway.Target()
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.WSPath = "/mqtt"
+			probe.WSSubprotocol = "mqtt"
+			probe.WSHeaders = map[string]config.Secret{"Authorization": "Bearer token"}
+			if tc.modify != nil {
+				tc.modify(&probe)
+			}
+			tunnels := gateway.Tunnels()
+
+			mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+			if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != tc.success {
+				t.Errorf("Expected emqx_mqtt_probe_success %v but got %v", tc.success, got)
+			}
+			if tc.failedPhase != "" {
+				if failed := gaugeValues(t, mfs["emqx_mqtt_probe_failed_phase"], probe.Target)[tc.failedPhase]; failed != 1 {
+					t.Errorf("Expected the phase %s to fail", tc.failedPhase)
+				}
+			}
+			mf, ok := mfs["emqx_mqtt_probe_ws_handshake_status_code"]
+			if tc.status == 0 {
+				if ok {
+					t.Errorf("Unexpected status code of the websocket handshake without response")
+				}
+			} else if !ok {
+				t.Errorf("Expected the status code %v of the websocket handshake", tc.status)
+			} else if got := gaugeValues(t, mf, probe.Target)[""]; got != tc.status {
+				t.Errorf("Expected the status code %v of the websocket handshake but got %v", tc.status, got)
+			}
+			if tunneled := gateway.Tunnels() > tunnels; tunneled != tc.tunneled {
+				t.Errorf("Expected the handshake to be tunneled by the proxy %v but got %v", tc.tunneled, tunneled)
+			}
+			if tc.success == 1 && !tc.tunneled {
+				subprotocols := gateway.Subprotocols()
+				if last := subprotocols[len(subprotocols)-1]; last != "mqtt" {
+					t.Errorf("Expected the subprotocol mqtt but got %q", last)
+				}
+			}
+			waitDisconnected(t, broker)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// willClientIDSuffix is appended to the client ID of the client with the will message of the will module.
+const willClientIDSuffix = "-will"
+
+// subscriberProbe returns the probe which only connects to the subscribe target, for the modules
+// which connect to the publish target by themselves.
+func subscriberProbe(probe config.Probe) config.Probe {
+	_, probe.Target = probeTargets(probe)
+	probe.PublishTarget, probe.SubscribeTarget = "", ""
+	return probe
+}
+
+// modulePayload returns the payload of the message of the module, which is unique to every probe,
+// so that the messages left by former probes aren't taken as the message of the probe.
+func modulePayload(module string) []byte {
+	return []byte(probeMessage + " " + module + " " + newRunID())
+}
+
+// seqPayload returns the payload of the message of the sequence number published by the module in the run.
+func seqPayload(module, runID string, seq int) []byte {
+	return []byte(probeMessage + " " + module + " " + runID + " " + strconv.Itoa(seq))
+}
+
+// parseSeqPayload returns the sequence number of the payload of seqPayload, ok is false if the message
+// isn't published by the module in the run.
+func parseSeqPayload(payload []byte, module, runID string) (seq int, ok bool) {
+	prefix := probeMessage + " " + module + " " + runID + " "
+	if !bytes.HasPrefix(payload, []byte(prefix)) {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(string(payload[len(prefix):]))
+	return seq, err == nil && seq >= 0
+}
+
+// probeRetained publishes a retained message, and checks that a fresh subscription receives it.
+// The retained message is cleared at last.
+func probeRetained(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	publishTarget, _ := probeTargets(probe)
+	payload := modulePayload(config.ProbeModuleRetained)
+
+	publisher := connect(clientOptions(ctx, probe, publishTarget, publisherClientID(probe), trace, logger), publishTarget, trace, logger)
+	if publisher == nil {
+		return false
+	}
+	defer publisher.Disconnect(0)
+	publish := func(payload []byte) error {
+		return waitPublish(ctx, publisher.Publish(probe.Topic, probe.QoS, true, payload), time.Duration(probe.KeepAlive)*time.Second)
+	}
+
+	start := time.Now()
+	err := publish(payload)
+	trace.observe(phasePublish, start)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to publish MQTT retained message", "target", publishTarget, "topic", probe.Topic, "qos", probe.QoS, "err", err)
+		trace.fail(phasePublish)
+		return false
+	}
+	defer func() {
+		if err := publish(nil); err != nil {
+			level.Warn(logger).Log("msg", "Failed to clear MQTT retained message", "target", publishTarget, "topic", probe.Topic, "err", err)
+		}
+	}()
+
+	mp := newMQTTProbe(ctx, subscriberProbe(probe), trace, logger)
+	if mp == nil {
+		return false
+	}
+	defer mp.disconnect()
+	return waitModuleMessage(ctx, probe, mp, payload, true, trace, start, logger)
+}
+
+// probeWill connects with a will message and drops the connection without DISCONNECT,
+// and checks that the subscription receives the will.
+func probeWill(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	publishTarget, _ := probeTargets(probe)
+	payload := modulePayload(config.ProbeModuleWill)
+
+	mp := newMQTTProbe(ctx, subscriberProbe(probe), trace, logger)
+	if mp == nil {
+		return false
+	}
+	defer mp.disconnect()
+
+	var conn net.Conn
+	opt := clientOptions(ctx, probe, publishTarget, probe.ClientID+willClientIDSuffix, trace, logger)
+	opt.SetBinaryWill(probe.Topic, payload, probe.QoS, false)
+	openConnection := trace.openConnection(ctx, probe)
+	opt.SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		var err error
+		conn, err = openConnection(uri, options)
+		return conn, err
+	})
+	opt.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		level.Debug(logger).Log("msg", "Dropped connection with MQTT will", "target", publishTarget, "err", err)
+	})
+	willClient := connect(opt, publishTarget, trace, logger)
+	if willClient == nil {
+		return false
+	}
+	defer willClient.Disconnect(0)
+
+	start := time.Now()
+	_ = conn.Close()
+	return waitModuleMessage(ctx, probe, mp, payload, false, trace, start, logger)
+}
+
+// probeRetained5 is probeRetained of MQTT 5.
+func probeRetained5(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	publishTarget, _ := probeTargets(probe)
+	payload := modulePayload(config.ProbeModuleRetained)
+
+	publisher := &MQTT5Probe{trace: trace}
+	c, _, _ := publisher.connect(ctx, probe, publishTarget, publisherClientID(probe), nil, nil, logger)
+	if c == nil {
+		return false
+	}
+	publisher.Client, publisher.Publisher = c, c
+	defer publisher.disconnect()
+	publish := func(payload []byte) error {
+		ctx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+		defer cancel()
+		pr, err := c.Publish(ctx, &paho.Publish{Topic: probe.Topic, QoS: probe.QoS, Retain: true, Payload: payload})
+		if err == nil && pr != nil && probe.QoS > 0 && pr.ReasonCode >= 0x80 {
+			err = fmt.Errorf("publish refused with reason code %#x", pr.ReasonCode)
+		}
+		return err
+	}
+
+	start := time.Now()
+	err := publish(payload)
+	trace.observe(phasePublish, start)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to publish MQTT retained message", "target", publishTarget, "topic", probe.Topic, "qos", probe.QoS, "err", err)
+		trace.fail(phasePublish)
+		return false
+	}
+	defer func() {
+		if err := publish(nil); err != nil {
+			level.Warn(logger).Log("msg", "Failed to clear MQTT retained message", "target", publishTarget, "topic", probe.Topic, "err", err)
+		}
+	}()
+
+	mp := newMQTT5Probe(ctx, subscriberProbe(probe), trace, logger)
+	if mp == nil {
+		return false
+	}
+	defer mp.disconnect()
+	return waitModuleMessage(ctx, probe, mp, payload, true, trace, start, logger)
+}
+
+// probeWill5 is probeWill of MQTT 5.
+func probeWill5(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	publishTarget, _ := probeTargets(probe)
+	payload := modulePayload(config.ProbeModuleWill)
+
+	mp := newMQTT5Probe(ctx, subscriberProbe(probe), trace, logger)
+	if mp == nil {
+		return false
+	}
+	defer mp.disconnect()
+
+	willProbe := &MQTT5Probe{trace: trace}
+	c, _, conn := willProbe.connect(ctx, probe, publishTarget, probe.ClientID+willClientIDSuffix, nil,
+		&paho.WillMessage{Topic: probe.Topic, QoS: probe.QoS, Payload: payload}, logger)
+	if c == nil {
+		return false
+	}
+
+	start := time.Now()
+	// The error of the dropped connection is expected.
+	willProbe.closed.Store(true)
+	_ = conn.Close()
+	return waitModuleMessage(ctx, probe, mp, payload, false, trace, start, logger)
+}
+
+// messageReceiver receives the messages of the subscription, it's implemented by MQTTProbe and MQTT5Probe.
+type messageReceiver interface {
+	receive(stop <-chan struct{}) (payload []byte, retained bool, ok bool)
+}
+
+// waitModuleMessage waits for the message of the payload for the keep alive or until ctx is done, the messages left
+// by others are skipped. The roundtrip since start is recorded, and the message must have the retain flag if retained
+// is true.
+func waitModuleMessage(ctx context.Context, probe config.Probe, mp messageReceiver, payload []byte, retained bool, trace *probeTrace, start time.Time, logger log.Logger) bool {
+	ctx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+	defer cancel()
+
+	for {
+		received, isRetained, ok := mp.receive(ctx.Done())
+		if !ok {
+			trace.observe(phaseRoundtrip, start)
+			level.Error(logger).Log("msg", "MQTT probe receive message timeout", "target", probe.Target, "module", probe.Module)
+			trace.fail(phaseRoundtrip)
+			return false
+		}
+		if !bytes.Equal(received, payload) {
+			continue
+		}
+		trace.observe(phaseRoundtrip, start)
+		if retained && !isRetained {
+			level.Error(logger).Log("msg", "MQTT probe received the message without the retain flag", "target", probe.Target, "module", probe.Module)
+			trace.fail(phaseRoundtrip)
+			return false
+		}
+		level.Debug(logger).Log("msg", "MQTT probe receive message success", "target", probe.Target, "module", probe.Module)
+		return true
+	}
+}
@@ -2,95 +2,291 @@ package prober
 
 import (
 	"emqx-exporter/config"
+
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 )
 
+// probeMessage is the payload of the message published by probes.
+const probeMessage = "from emqx-exporter MQTT probe"
+
+// messageBuffer is the capacity of the channels of the received messages, so that the messages published
+// continuously by the persistent probe aren't dropped while the former one is being handled.
+const messageBuffer = 64
+
 type MQTTProbe struct {
 	Client  mqtt.Client
 	MsgChan <-chan mqtt.Message
+	// Publisher is the client connected to the publish target of the cross-node probe, otherwise it's the Client.
+	Publisher mqtt.Client
+
+	trace *probeTrace
 }
 
-func newMQTTProbe(probe config.Probe, logger log.Logger) *MQTTProbe {
-	var isReady = make(chan struct{})
-	var msgChan = make(chan mqtt.Message)
+// newMQTTProbe connects to the target and subscribes to the topic of the probe, and connects to the publish target
+// for the cross-node probe. The durations of the phases and the phase which failed are recorded by the trace.
+func newMQTTProbe(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) *MQTTProbe {
+	publishTarget, subscribeTarget := probeTargets(probe)
 
-	opt := mqtt.NewClientOptions().AddBroker(probe.Scheme + "://" + probe.Target)
-	opt.SetCleanSession(true)
-	opt.SetClientID(probe.ClientID)
-	opt.SetUsername(probe.Username)
-	opt.SetPassword(probe.Password)
-	opt.SetKeepAlive(time.Duration(probe.KeepAlive) * time.Second)
-	opt.SetPingTimeout(time.Duration(probe.PingTimeout) * time.Second)
-	opt.SetConnectTimeout(time.Duration(probe.ConnectTimeout) * time.Second)
-	if probe.TLSClientConfig != nil {
-		opt.SetTLSConfig(probe.TLSClientConfig.ToTLSConfig())
-	}
+	// The channels are buffered and written without blocking, so that the callbacks of the
+	// client never block when the probe has already given up.
+	var isReady = make(chan error, 1)
+	var msgChan = make(chan mqtt.Message, messageBuffer)
+
+	opt := clientOptions(ctx, probe, subscribeTarget, probe.ClientID, trace, logger)
 	opt.SetOnConnectHandler(func(c mqtt.Client) {
 		optReader := c.OptionsReader()
-		level.Debug(logger).Log("msg", "Connected to MQTT broker", "target", probe.Target, "client_id", optReader.ClientID())
+		level.Debug(logger).Log("msg", "Connected to MQTT broker", "target", subscribeTarget, "client_id", optReader.ClientID())
+		start := time.Now()
 		token := c.Subscribe(probe.Topic, probe.QoS, func(c mqtt.Client, m mqtt.Message) {
-			msgChan <- m
+			select {
+			case msgChan <- m:
+			default:
+			}
 		})
-		token.Wait()
-		if token.Error() != nil {
-			level.Error(logger).Log("msg", "Failed to subscribe to MQTT topic", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS, "err", token.Error())
+		err := subscribeError(token, trace)
+		trace.observe(phaseSubscribe, start)
+		if err != nil {
+			trace.fail(phaseSubscribe)
+		}
+		select {
+		case isReady <- err:
+		default:
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to subscribe to MQTT topic", "target", subscribeTarget, "topic", probe.Topic, "qos", probe.QoS, "err", err)
 			return
 		}
-		isReady <- struct{}{}
-		level.Debug(logger).Log("msg", "Subscribed to MQTT topic", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS)
+		level.Debug(logger).Log("msg", "Subscribed to MQTT topic", "target", subscribeTarget, "topic", probe.Topic, "qos", probe.QoS)
 	})
-	opt.SetConnectionLostHandler(func(c mqtt.Client, err error) {
-		level.Error(logger).Log("msg", "Lost connection to MQTT broker", "target", probe.Target, "err", err)
-	})
-	c := mqtt.NewClient(opt)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		level.Error(logger).Log("msg", "Failed to connect to MQTT broker", "target", probe.Target, "err", token.Error())
+	c := connect(opt, subscribeTarget, trace, logger)
+	if c == nil {
 		return nil
 	}
 
+	readyCtx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+	defer cancel()
 	select {
-	case <-isReady:
-	case <-time.After(time.Duration(probe.KeepAlive) * time.Second):
-		level.Error(logger).Log("msg", "MQTT probe connect timeout", "target", probe.Target)
+	case err := <-isReady:
+		if err != nil {
+			c.Disconnect(0)
+			return nil
+		}
+	case <-readyCtx.Done():
+		level.Error(logger).Log("msg", "MQTT probe connect timeout", "target", subscribeTarget, "err", readyCtx.Err())
+		trace.fail(phaseSubscribe)
+		c.Disconnect(0)
 		return nil
 	}
 
-	return &MQTTProbe{
-		Client:  c,
-		MsgChan: msgChan,
+	mp := &MQTTProbe{
+		Client:    c,
+		MsgChan:   msgChan,
+		Publisher: c,
+		trace:     trace,
+	}
+	if probe.PublishTarget != "" {
+		opt := clientOptions(ctx, probe, publishTarget, publisherClientID(probe), trace, logger)
+		opt.SetOnConnectHandler(func(c mqtt.Client) {
+			level.Debug(logger).Log("msg", "Connected to MQTT broker", "target", publishTarget, "client_id", publisherClientID(probe))
+		})
+		if mp.Publisher = connect(opt, publishTarget, trace, logger); mp.Publisher == nil {
+			c.Disconnect(0)
+			return nil
+		}
+	}
+	return mp
+}
+
+// clientOptions returns the options of the client connecting to the target, which is `host:port` or `scheme://host:port`.
+// The connection of the client is closed once ctx is done.
+func clientOptions(ctx context.Context, probe config.Probe, target, clientID string, trace *probeTrace, logger log.Logger) *mqtt.ClientOptions {
+	opt := mqtt.NewClientOptions().AddBroker(targetURL(probe.Scheme, target).String())
+	opt.SetCleanSession(true)
+	// The probes fail on the loss of the connection, and the persistent probe reconnects by itself.
+	opt.SetAutoReconnect(false)
+	opt.SetClientID(clientID)
+	opt.SetUsername(probe.Username)
+	opt.SetPassword(string(probe.Password))
+	opt.SetKeepAlive(time.Duration(probe.KeepAlive) * time.Second)
+	opt.SetPingTimeout(time.Duration(probe.PingTimeout) * time.Second)
+	opt.SetConnectTimeout(time.Duration(probe.ConnectTimeout) * time.Second)
+	if probe.ProtocolVersion != 0 {
+		opt.SetProtocolVersion(probe.ProtocolVersion)
+	}
+	if probe.TLSClientConfig != nil {
+		opt.SetTLSConfig(probe.TLSClientConfig.ToTLSConfig(targetURL(probe.Scheme, target).Hostname()))
+	}
+	opt.SetCustomOpenConnectionFn(trace.openConnection(ctx, probe))
+	opt.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		level.Error(logger).Log("msg", "Lost connection to MQTT broker", "target", target, "err", err)
+	})
+	return opt
+}
+
+// connect connects the client of the options to the target, it returns nil if the connection fails.
+func connect(opt *mqtt.ClientOptions, target string, trace *probeTrace, logger log.Logger) mqtt.Client {
+	c, _ := connectSession(opt, target, trace, logger)
+	return c
+}
+
+// connectSession is connect which also returns the session present flag of CONNACK.
+func connectSession(opt *mqtt.ClientOptions, target string, trace *probeTrace, logger log.Logger) (mqtt.Client, bool) {
+	c := mqtt.NewClient(opt)
+	token := c.Connect()
+	token.Wait()
+	if opened := trace.connectionOpened(); !opened.IsZero() {
+		trace.observe(phaseConnack, opened)
+	}
+	// The return code is only known if CONNACK has been received.
+	if rc := token.(*mqtt.ConnectToken).ReturnCode(); rc < packets.ErrNetworkError {
+		trace.observeReasonCode(packetConnack, rc)
+	}
+	if token.Error() != nil {
+		// The failures to open the network connection have been recorded by the trace.
+		trace.fail(phaseConnack)
+		level.Error(logger).Log("msg", "Failed to connect to MQTT broker", "target", target, "err", token.Error())
+		return nil, false
 	}
+	return c, token.(*mqtt.ConnectToken).SessionPresent()
 }
 
-func (mp *MQTTProbe) Probe(probe config.Probe, logger log.Logger) bool {
-	defer mp.Client.Disconnect(0)
+func (mp *MQTTProbe) Probe(ctx context.Context, probe config.Probe, logger log.Logger) bool {
+	defer mp.disconnect()
 
-	if !mp.Client.IsConnected() {
+	if !mp.Client.IsConnected() || !mp.Publisher.IsConnected() {
 		level.Error(logger).Log("msg", "MQTT client is not connected", "target", probe.Target)
+		mp.trace.fail(phasePublish)
 		return false
 	}
 
 	level.Debug(logger).Log("msg", "Publishing MQTT message", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS)
 
-	message := "from emqx-exporter MQTT probe"
-	if token := mp.Client.Publish(probe.Topic, probe.QoS, false, message); token.Wait() && token.Error() != nil {
-		level.Error(logger).Log("msg", "Failed to publish MQTT message", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS, "err", token.Error())
+	start := time.Now()
+	err := mp.publish(ctx, probe, []byte(probeMessage))
+	mp.trace.observe(phasePublish, start)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to publish MQTT message", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS, "err", err)
+		mp.trace.fail(phasePublish)
 		return false
 	}
 
+	ctx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+	defer cancel()
 	select {
 	case msg := <-mp.MsgChan:
-		if msg != nil && string(msg.Payload()) == message {
+		mp.trace.observe(phaseRoundtrip, start)
+		if msg != nil && string(msg.Payload()) == probeMessage {
 			level.Debug(logger).Log("msg", "MQTT probe receive message success", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS)
 			return true
 		}
 		level.Error(logger).Log("msg", "MQTT probe receive message failed", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS)
+		mp.trace.fail(phaseRoundtrip)
 		return false
-	case <-time.After(time.Duration(probe.KeepAlive) * time.Second):
-		level.Error(logger).Log("msg", "MQTT probe receive message timeout", "target", probe.Target)
+	case <-ctx.Done():
+		level.Error(logger).Log("msg", "MQTT probe receive message timeout", "target", probe.Target, "err", ctx.Err())
+		mp.trace.observe(phaseRoundtrip, start)
+		mp.trace.fail(phaseRoundtrip)
 		return false
 	}
 }
+
+// publish publishes the payload to the topic of the probe, and waits for its completion for the keep alive at most.
+func (mp *MQTTProbe) publish(ctx context.Context, probe config.Probe, payload []byte) error {
+	return waitPublish(ctx, mp.Publisher.Publish(probe.Topic, probe.QoS, false, payload), time.Duration(probe.KeepAlive)*time.Second)
+}
+
+// waitPublish waits for the completion of the publish token for the timeout at most, or until ctx is done, and
+// returns its error.
+func waitPublish(ctx context.Context, token mqtt.Token, timeout time.Duration) error {
+	ctx, cancel := timeoutContext(ctx, timeout)
+	defer cancel()
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return errors.New("publish timeout")
+		}
+		return ctx.Err()
+	}
+}
+
+// receive waits for the next message from the subscription and returns its payload and retain flag,
+// ok is false when stop is closed.
+func (mp *MQTTProbe) receive(stop <-chan struct{}) (payload []byte, retained bool, ok bool) {
+	select {
+	case msg := <-mp.MsgChan:
+		return msg.Payload(), msg.Retained(), true
+	case <-stop:
+		return nil, false, false
+	}
+}
+
+func (mp *MQTTProbe) connected() bool {
+	return mp.Client.IsConnected() && mp.Publisher.IsConnected()
+}
+
+func (mp *MQTTProbe) disconnect() {
+	if mp.Publisher != mp.Client {
+		mp.Publisher.Disconnect(0)
+	}
+	mp.Client.Disconnect(0)
+}
+
+// subscribeError waits for the subscription and returns its error, including the failure
+// return code 0x80 of SUBACK which isn't reported as an error by the client. The return code
+// is recorded by the trace. The results are keyed by the topic without the prefix of the shared
+// subscription, so all of them are checked.
+func subscribeError(token mqtt.Token, trace *probeTrace) error {
+	token.Wait()
+	if token.Error() != nil {
+		return token.Error()
+	}
+	if st, ok := token.(*mqtt.SubscribeToken); ok {
+		for _, code := range st.Result() {
+			trace.observeReasonCode(packetSuback, code)
+			if code >= 0x80 {
+				return fmt.Errorf("subscription refused with return code %#x", code)
+			}
+		}
+	}
+	return nil
+}
+
+// probeTargets returns the targets to publish the message to and to subscribe to, they're both
+// the target unless it's the cross-node probe.
+func probeTargets(probe config.Probe) (publishTarget, subscribeTarget string) {
+	if probe.PublishTarget != "" {
+		return probe.PublishTarget, probe.SubscribeTarget
+	}
+	return probe.Target, probe.Target
+}
+
+// publisherClientID returns the client ID of the publisher of the cross-node probe.
+func publisherClientID(probe config.Probe) string {
+	return probe.ClientID + "-pub"
+}
+
+// targetURL returns the URL of the target, which is `host:port` of the scheme, or `scheme://host:port` which
+// may have the path of the websocket endpoint.
+func targetURL(scheme, target string) *url.URL {
+	if i := strings.Index(target, "://"); i >= 0 {
+		host, path, _ := strings.Cut(target[i+len("://"):], "/")
+		u := &url.URL{Scheme: target[:i], Host: host}
+		if path != "" {
+			u.Path = "/" + path
+		}
+		return u
+	}
+	return &url.URL{Scheme: scheme, Host: target}
+}
@@ -0,0 +1,298 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// MQTT5Probe is an MQTT 5 client subscribed to the topic of the probe.
+type MQTT5Probe struct {
+	Client  *paho.Client
+	MsgChan <-chan *paho.Publish
+	// Publisher is the client connected to the publish target of the cross-node probe, otherwise it's the Client.
+	Publisher *paho.Client
+
+	// topicAliasMaximum is the topic alias maximum of the broker of the publisher from CONNACK.
+	topicAliasMaximum uint16
+	trace             *probeTrace
+	// closed is set when the probe closes the connections, so that the errors of them aren't reported as lost.
+	closed atomic.Bool
+	// resume connects without clean start, so that the session of the client ID is resumed.
+	resume bool
+}
+
+// newMQTT5Probe connects to the target by MQTT 5 and subscribes to the topic of the probe, and connects to
+// the publish target for the cross-node probe. The durations of the phases, the phase which failed and
+// the reason codes are recorded by the trace.
+func newMQTT5Probe(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) *MQTT5Probe {
+	publishTarget, subscribeTarget := probeTargets(probe)
+
+	// The channel is buffered and written without blocking, so that the callback of the
+	// client never blocks when the probe has already given up.
+	var msgChan = make(chan *paho.Publish, messageBuffer)
+	mp := &MQTT5Probe{
+		MsgChan: msgChan,
+		trace:   trace,
+	}
+	c, ca, _ := mp.connect(ctx, probe, subscribeTarget, probe.ClientID, func(pr paho.PublishReceived) (bool, error) {
+		select {
+		case msgChan <- pr.Packet:
+		default:
+		}
+		return true, nil
+	}, nil, logger)
+	if c == nil {
+		return nil
+	}
+	mp.Client = c
+	mp.Publisher = c
+
+	subscribeCtx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+	defer cancel()
+	start := time.Now()
+	sa, err := c.Subscribe(subscribeCtx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: probe.Topic, QoS: probe.QoS}},
+	})
+	trace.observe(phaseSubscribe, start)
+	if sa != nil && len(sa.Reasons) > 0 {
+		trace.observeReasonCode(packetSuback, sa.Reasons[0])
+	}
+	if err != nil {
+		trace.fail(phaseSubscribe)
+		level.Error(logger).Log("msg", "Failed to subscribe to MQTT topic", "target", subscribeTarget, "topic", probe.Topic, "qos", probe.QoS, "err", err)
+		mp.disconnect()
+		return nil
+	}
+	level.Debug(logger).Log("msg", "Subscribed to MQTT topic", "target", subscribeTarget, "topic", probe.Topic, "qos", probe.QoS)
+
+	if probe.PublishTarget != "" {
+		publisher, pca, _ := mp.connect(ctx, probe, publishTarget, publisherClientID(probe), nil, nil, logger)
+		if publisher == nil {
+			mp.disconnect()
+			return nil
+		}
+		mp.Publisher, ca = publisher, pca
+	}
+	if ca.Properties != nil && ca.Properties.TopicAliasMaximum != nil {
+		mp.topicAliasMaximum = *ca.Properties.TopicAliasMaximum
+	}
+	return mp
+}
+
+// connect connects a client to the target by MQTT 5 with the will message if it isn't nil, and returns the client,
+// CONNACK and the network connection. The client is nil if the connection fails, and the connection is closed once
+// ctx is done.
+func (mp *MQTT5Probe) connect(ctx context.Context, probe config.Probe, target, clientID string, onPublish func(paho.PublishReceived) (bool, error),
+	will *paho.WillMessage, logger log.Logger) (*paho.Client, *paho.Connack, net.Conn) {
+	uri := targetURL(probe.Scheme, target)
+	var tlsConfig *tls.Config
+	if probe.TLSClientConfig != nil {
+		tlsConfig = probe.TLSClientConfig.ToTLSConfig(uri.Hostname())
+	}
+	conn, err := mp.trace.dial(ctx, uri, tlsConfig, newWebsocketOptions(probe), time.Duration(probe.ConnectTimeout)*time.Second)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to connect to MQTT broker", "target", target, "err", err)
+		return nil, nil, nil
+	}
+
+	cc := paho.ClientConfig{
+		ClientID:      clientID,
+		Conn:          packets.NewThreadSafeConn(conn),
+		PacketTimeout: time.Duration(max(probe.ConnectTimeout, probe.KeepAlive)) * time.Second,
+		OnClientError: func(err error) {
+			if mp.closed.Load() {
+				return
+			}
+			level.Error(logger).Log("msg", "Lost connection to MQTT broker", "target", target, "err", err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			level.Error(logger).Log("msg", "Disconnected by MQTT broker", "target", target, "reason_code", d.ReasonCode)
+		},
+	}
+	if onPublish != nil {
+		cc.OnPublishReceived = []func(paho.PublishReceived) (bool, error){onPublish}
+	}
+	c := paho.NewClient(cc)
+
+	cp := &paho.Connect{
+		ClientID:     clientID,
+		KeepAlive:    uint16(probe.KeepAlive),
+		CleanStart:   !mp.resume,
+		Username:     probe.Username,
+		UsernameFlag: probe.Username != "",
+		Password:     []byte(probe.Password),
+		PasswordFlag: probe.Password != "",
+		WillMessage:  will,
+	}
+	if probe.SessionExpiryInterval > 0 {
+		cp.Properties = &paho.ConnectProperties{SessionExpiryInterval: &probe.SessionExpiryInterval}
+	}
+
+	connectCtx, cancel := timeoutContext(ctx, time.Duration(probe.ConnectTimeout)*time.Second)
+	defer cancel()
+	start := time.Now()
+	ca, err := c.Connect(connectCtx, cp)
+	mp.trace.observe(phaseConnack, start)
+	if ca != nil {
+		mp.trace.observeReasonCode(packetConnack, ca.ReasonCode)
+	}
+	if err != nil {
+		mp.trace.fail(phaseConnack)
+		level.Error(logger).Log("msg", "Failed to connect to MQTT broker", "target", target, "err", err)
+		mp.closed.Store(true)
+		_ = conn.Close()
+		return nil, nil, nil
+	}
+	level.Debug(logger).Log("msg", "Connected to MQTT broker", "target", target, "client_id", clientID)
+	return c, ca, conn
+}
+
+func (mp *MQTT5Probe) Probe(ctx context.Context, probe config.Probe, logger log.Logger) bool {
+	defer mp.disconnect()
+
+	if probe.TopicAlias > mp.topicAliasMaximum {
+		level.Error(logger).Log("msg", "MQTT probe topic alias exceeds the maximum of the broker", "target", probe.Target, "topic_alias", probe.TopicAlias, "topic_alias_maximum", mp.topicAliasMaximum)
+		mp.trace.fail(phasePublish)
+		return false
+	}
+
+	level.Debug(logger).Log("msg", "Publishing MQTT message", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS)
+
+	start := time.Now()
+	pr, err := mp.publishMessage(ctx, probe, []byte(probeMessage))
+	mp.trace.observe(phasePublish, start)
+	if pr != nil && probe.QoS > 0 {
+		mp.trace.observeReasonCode(packetPuback, pr.ReasonCode)
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to publish MQTT message", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS, "err", err)
+		mp.trace.fail(phasePublish)
+		return false
+	}
+
+	ctx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+	defer cancel()
+	select {
+	case msg := <-mp.MsgChan:
+		mp.trace.observe(phaseRoundtrip, start)
+		if msg != nil && string(msg.Payload) == probeMessage && hasUserProperties(msg, probe.UserProperties) {
+			level.Debug(logger).Log("msg", "MQTT probe receive message success", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS)
+			return true
+		}
+		level.Error(logger).Log("msg", "MQTT probe receive message failed", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS)
+		mp.trace.fail(phaseRoundtrip)
+		return false
+	case <-ctx.Done():
+		level.Error(logger).Log("msg", "MQTT probe receive message timeout", "target", probe.Target, "err", ctx.Err())
+		mp.trace.observe(phaseRoundtrip, start)
+		mp.trace.fail(phaseRoundtrip)
+		return false
+	}
+}
+
+// publishMessage publishes the payload with the user properties and the topic alias of the probe, and waits for
+// its completion for the keep alive at most. The failure reason code of the acknowledgement is returned as an error.
+func (mp *MQTT5Probe) publishMessage(ctx context.Context, probe config.Probe, payload []byte) (*paho.PublishResponse, error) {
+	publish := &paho.Publish{
+		Topic:      probe.Topic,
+		QoS:        probe.QoS,
+		Payload:    payload,
+		Properties: &paho.PublishProperties{User: userProperties(probe.UserProperties)},
+	}
+	if probe.TopicAlias > 0 {
+		publish.Properties.TopicAlias = &probe.TopicAlias
+	}
+
+	ctx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+	defer cancel()
+	pr, err := mp.Publisher.Publish(ctx, publish)
+	if err == nil && pr != nil && probe.QoS > 0 && pr.ReasonCode >= 0x80 {
+		err = fmt.Errorf("publish refused with reason code %#x", pr.ReasonCode)
+	}
+	return pr, err
+}
+
+func (mp *MQTT5Probe) publish(ctx context.Context, probe config.Probe, payload []byte) error {
+	_, err := mp.publishMessage(ctx, probe, payload)
+	return err
+}
+
+// receive waits for the next message from the subscription and returns its payload and retain flag,
+// ok is false when stop is closed.
+func (mp *MQTT5Probe) receive(stop <-chan struct{}) (payload []byte, retained bool, ok bool) {
+	select {
+	case msg := <-mp.MsgChan:
+		return msg.Payload, msg.Retain, true
+	case <-stop:
+		return nil, false, false
+	}
+}
+
+func (mp *MQTT5Probe) connected() bool {
+	for _, c := range []*paho.Client{mp.Client, mp.Publisher} {
+		select {
+		case <-c.Done():
+			return false
+		default:
+		}
+	}
+	return true
+}
+
+func (mp *MQTT5Probe) disconnect() {
+	mp.closed.Store(true)
+	if mp.Publisher != mp.Client {
+		_ = mp.Publisher.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+	_ = mp.Client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+}
+
+// userProperties returns the user properties sorted by key, so that the packets of probes are the same.
+func userProperties(properties map[string]string) paho.UserProperties {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var user paho.UserProperties
+	for _, key := range keys {
+		user.Add(key, properties[key])
+	}
+	return user
+}
+
+// hasUserProperties returns whether the message has all the user properties.
+func hasUserProperties(msg *paho.Publish, properties map[string]string) bool {
+	if len(properties) == 0 {
+		return true
+	}
+	if msg.Properties == nil {
+		return false
+	}
+	for key, value := range properties {
+		found := false
+		for _, v := range msg.Properties.User.GetAll(key) {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
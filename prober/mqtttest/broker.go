@@ -0,0 +1,354 @@
+// Package mqtttest provides an in-process MQTT broker for hermetic tests of the prober.
+package mqtttest
+
+import (
+	"emqx-exporter/config"
+
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	// Username is the username accepted by the broker.
+	Username = "emqx_exporter_test_user"
+	// Password is the password accepted by the broker.
+	Password = "emqx_exporter_test_password"
+)
+
+// defaultTopicAliasMaximum is the topic alias maximum in CONNACK of MQTT 5 by default, the same as EMQX.
+const defaultTopicAliasMaximum = 65535
+
+// Broker is an MQTT broker listening on TCP, TLS and WebSocket on the loopback interface.
+// The clients must connect with the Username and Password, and the behaviour of the broker can be
+// scripted by the helpers for fault injection, which are cleared by Reset.
+type Broker struct {
+	server *mqtt.Server
+	caPEM  []byte
+	addrs  map[string]string
+
+	mtx            sync.Mutex
+	rejectConnect  bool
+	denySubscribe  bool
+	denyPublish    bool
+	dropPublish    bool
+	replacePayload []byte
+	dropUserProps  bool
+	topicAliasMax  uint16
+	connected      int
+	publishes      int
+	// publishers are the client IDs which published on the topics.
+	publishers map[string]map[string]struct{}
+}
+
+// NewBroker starts a broker, it should be closed by Close.
+func NewBroker() *Broker {
+	caPEM, cert, err := newCertificates()
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to generate certificates: %v", err))
+	}
+
+	b := &Broker{
+		caPEM:         caPEM,
+		addrs:         make(map[string]string, 3),
+		topicAliasMax: defaultTopicAliasMaximum,
+		publishers:    make(map[string]map[string]struct{}),
+	}
+	b.server = mqtt.New(&mqtt.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := b.server.AddHook(&hook{broker: b}, nil); err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to add hook: %v", err))
+	}
+
+	tcp := listen()
+	b.addListener(listeners.NewNet("tcp", tcp))
+	tlsListener := tls.NewListener(listen(), &tls.Config{Certificates: []tls.Certificate{cert}})
+	b.addListener(listeners.NewNet("ssl", tlsListener))
+	// The websocket listener binds the address by itself, so a free port is reserved first.
+	ws := listen()
+	wsAddr := ws.Addr().String()
+	ws.Close()
+	b.addListener(listeners.NewWebsocket("ws", wsAddr, nil))
+
+	if err := b.server.Serve(); err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to serve: %v", err))
+	}
+	waitListening(wsAddr)
+	return b
+}
+
+// waitListening waits for the address to accept connections, since the websocket listener
+// starts listening in the background after Serve returns.
+func waitListening(addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Sprintf("mqtttest: listener %s isn't ready: %v", addr, err))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func listen() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to listen on a port: %v", err))
+	}
+	return l
+}
+
+func (b *Broker) addListener(l listeners.Listener) {
+	if err := b.server.AddListener(l); err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to add listener %s: %v", l.ID(), err))
+	}
+	b.addrs[l.ID()] = l.Address()
+}
+
+// Close stops the broker and disconnects all clients.
+func (b *Broker) Close() {
+	_ = b.server.Close()
+}
+
+// Target returns the address of the listener of the scheme, i.e. `host:port`.
+// The schemes are `tcp`, `ssl` and `ws`.
+func (b *Broker) Target(scheme string) string {
+	addr, ok := b.addrs[scheme]
+	if !ok {
+		panic(fmt.Sprintf("mqtttest: unknown scheme %q", scheme))
+	}
+	return addr
+}
+
+// CAPEM returns the PEM of the CA which signs the certificate of the TLS listener.
+func (b *Broker) CAPEM() []byte {
+	return b.caPEM
+}
+
+// Probe returns the probe config of the listener of the scheme. The timeouts are 1 second,
+// so that the failed probes complete quickly.
+func (b *Broker) Probe(scheme string) config.Probe {
+	probe := config.Probe{
+		Target:         b.Target(scheme),
+		Scheme:         scheme,
+		ClientID:       "emqx-exporter-probe-test",
+		Username:       Username,
+		Password:       Password,
+		Topic:          "emqx-exporter-probe/test",
+		KeepAlive:      1,
+		PingTimeout:    1,
+		ConnectTimeout: 1,
+	}
+	if scheme == "ssl" {
+		probe.TLSClientConfig = &config.TLSClientConfig{CAData: b.CAPEM()}
+	}
+	return probe
+}
+
+// Reset clears the scripted faults, the count of publishes and their publishers.
+func (b *Broker) Reset() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.rejectConnect = false
+	b.denySubscribe = false
+	b.denyPublish = false
+	b.dropPublish = false
+	b.replacePayload = nil
+	b.dropUserProps = false
+	b.topicAliasMax = defaultTopicAliasMaximum
+	b.publishes = 0
+	b.publishers = make(map[string]map[string]struct{})
+}
+
+// RejectConnect scripts the broker to refuse all connections with `bad username or password`.
+func (b *Broker) RejectConnect() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.rejectConnect = true
+}
+
+// DenySubscribe scripts the broker to refuse all subscriptions with `not authorized`.
+func (b *Broker) DenySubscribe() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.denySubscribe = true
+}
+
+// DenyPublish scripts the broker to refuse all published messages with `not authorized`. The messages of
+// QoS 0 are dropped, and the clients of MQTT 3 publishing QoS 1 and 2 are disconnected.
+func (b *Broker) DenyPublish() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.denyPublish = true
+}
+
+// DropPublish scripts the broker to drop all published messages silently, without acknowledging them.
+// The will messages are dropped too.
+func (b *Broker) DropPublish() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.dropPublish = true
+}
+
+// ReplacePayload scripts the broker to deliver all published messages with the payload.
+func (b *Broker) ReplacePayload(payload string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.replacePayload = []byte(payload)
+}
+
+// DropUserProperties scripts the broker to deliver all published messages without their user properties of MQTT 5.
+func (b *Broker) DropUserProperties() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.dropUserProps = true
+}
+
+// SetTopicAliasMaximum scripts the topic alias maximum in CONNACK of MQTT 5, 0 means topic aliases aren't allowed.
+func (b *Broker) SetTopicAliasMaximum(maximum uint16) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.topicAliasMax = maximum
+}
+
+// DisconnectAll closes the connections of all clients, as if the network failed.
+func (b *Broker) DisconnectAll() {
+	for _, cl := range b.server.Clients.GetAll() {
+		if !cl.Closed() {
+			cl.Stop(errors.New("mqtttest: disconnected"))
+		}
+	}
+}
+
+// Connected returns the number of connected clients.
+func (b *Broker) Connected() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.connected
+}
+
+// Publishes returns how many messages have been published since the last Reset.
+func (b *Broker) Publishes() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.publishes
+}
+
+// Publishers returns the client IDs which have published on the topic since the last Reset, in no particular order.
+func (b *Broker) Publishers(topic string) []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	clientIDs := make([]string, 0, len(b.publishers[topic]))
+	for clientID := range b.publishers[topic] {
+		clientIDs = append(clientIDs, clientID)
+	}
+	return clientIDs
+}
+
+// hook authenticates the clients and applies the scripted faults of the broker.
+type hook struct {
+	mqtt.HookBase
+	broker *Broker
+}
+
+func (h *hook) ID() string {
+	return "emqx-exporter-test"
+}
+
+func (h *hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnACLCheck,
+		mqtt.OnPublish,
+		mqtt.OnWill,
+		mqtt.OnPacketEncode,
+	}, []byte{b})
+}
+
+func (h *hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	h.broker.mtx.Lock()
+	defer h.broker.mtx.Unlock()
+	if h.broker.rejectConnect {
+		return false
+	}
+	return string(cl.Properties.Username) == Username && string(pk.Connect.Password) == Password
+}
+
+func (h *hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.broker.mtx.Lock()
+	defer h.broker.mtx.Unlock()
+	h.broker.connected++
+}
+
+func (h *hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.broker.mtx.Lock()
+	defer h.broker.mtx.Unlock()
+	h.broker.connected--
+}
+
+func (h *hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	h.broker.mtx.Lock()
+	defer h.broker.mtx.Unlock()
+	if write {
+		return !h.broker.denyPublish
+	}
+	return !h.broker.denySubscribe
+}
+
+// OnPacketEncode advertises the topic alias maximum in CONNACK, which isn't sent by the server itself.
+func (h *hook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if pk.FixedHeader.Type == packets.Connack && pk.ReasonCode < 0x80 {
+		h.broker.mtx.Lock()
+		defer h.broker.mtx.Unlock()
+		pk.Properties.TopicAliasMaximum = h.broker.topicAliasMax
+	}
+	return pk
+}
+
+func (h *hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.broker.mtx.Lock()
+	defer h.broker.mtx.Unlock()
+	h.broker.publishes++
+	if h.broker.publishers[pk.TopicName] == nil {
+		h.broker.publishers[pk.TopicName] = make(map[string]struct{})
+	}
+	h.broker.publishers[pk.TopicName][cl.ID] = struct{}{}
+	if h.broker.dropPublish {
+		return pk, packets.ErrRejectPacket
+	}
+	if h.broker.replacePayload != nil {
+		pk.Payload = h.broker.replacePayload
+	}
+	if h.broker.dropUserProps {
+		pk.Properties.User = nil
+	}
+	return pk, nil
+}
+
+// OnWill drops the will message by sending it to a topic which can't be subscribed, as the server doesn't
+// allow the hooks to cancel it.
+func (h *hook) OnWill(cl *mqtt.Client, will mqtt.Will) (mqtt.Will, error) {
+	h.broker.mtx.Lock()
+	defer h.broker.mtx.Unlock()
+	if h.broker.dropPublish {
+		will.TopicName = "$mqtttest/dropped"
+	}
+	return will, nil
+}
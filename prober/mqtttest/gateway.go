@@ -0,0 +1,74 @@
+package mqtttest
+
+import (
+	"emqx-exporter/internal/tunneltest"
+
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+)
+
+// Gateway is an HTTP server in front of the websocket listener of the broker like an ingress. It forwards the
+// websocket handshakes of its path which carry its headers, and responds the others with 404 or 401.
+// It also tunnels the CONNECT requests like an HTTP proxy.
+type Gateway struct {
+	*httptest.Server
+	path    string
+	headers http.Header
+	proxy   *httputil.ReverseProxy
+	tunnel  tunneltest.Tunneler
+
+	mtx          sync.Mutex
+	subprotocols []string
+}
+
+// NewGateway starts a gateway of the broker, it should be closed by Close.
+func NewGateway(broker *Broker, path string, headers http.Header) *Gateway {
+	g := &Gateway{
+		path:    path,
+		headers: headers,
+		proxy:   httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: broker.Target("ws")}),
+	}
+	g.Server = httptest.NewServer(http.HandlerFunc(g.serveHTTP))
+	return g
+}
+
+// Target returns the address of the gateway, i.e. `host:port`.
+func (g *Gateway) Target() string {
+	return g.Listener.Addr().String()
+}
+
+// Tunnels returns the number of the CONNECT requests tunneled by the gateway.
+func (g *Gateway) Tunnels() int {
+	return g.tunnel.Tunnels()
+}
+
+// Subprotocols returns the subprotocols requested by the websocket handshakes forwarded by the gateway.
+func (g *Gateway) Subprotocols() []string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return append([]string(nil), g.subprotocols...)
+}
+
+func (g *Gateway) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		g.tunnel.Tunnel(w, r)
+		return
+	}
+	if r.URL.Path != g.path {
+		http.NotFound(w, r)
+		return
+	}
+	for name := range g.headers {
+		if r.Header.Get(name) != g.headers.Get(name) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	g.mtx.Lock()
+	g.subprotocols = append(g.subprotocols, r.Header.Get("Sec-WebSocket-Protocol"))
+	g.mtx.Unlock()
+	g.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,247 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// persistentTopicSuffix is appended to the topic of the persistent probe, so that its messages aren't
+// received by the probes on /probe which subscribe to the topic.
+const persistentTopicSuffix = "/persistent"
+
+// persistentConn is the connection of the persistent probe, it's implemented by MQTTProbe and MQTT5Probe.
+type persistentConn interface {
+	publish(ctx context.Context, probe config.Probe, payload []byte) error
+	receive(stop <-chan struct{}) (payload []byte, retained bool, ok bool)
+	connected() bool
+	disconnect()
+}
+
+// runPersistent keeps one connection to the target, publishing a sequence-numbered message at every
+// interval until the probe is stopped. The connection is reopened at the next interval once it's lost.
+func (s *Scheduler) runPersistent(sp *scheduledProbe) {
+	defer close(sp.done)
+
+	probe := sp.probe
+	probe.ClientID += backgroundClientIDSuffix
+	probe.Topic += persistentTopicSuffix
+	logger := log.With(s.logger, "background", true, "persistent", true)
+	tracker := newSequenceTracker(newRunID(), time.Duration(probe.KeepAlive)*time.Second)
+
+	var (
+		conn        persistentConn
+		stopReceive chan struct{}
+		connects    int
+	)
+	closeConn := func() {
+		close(stopReceive)
+		conn.disconnect()
+		conn = nil
+	}
+	defer func() {
+		if conn != nil {
+			closeConn()
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(probe.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if conn != nil && !conn.connected() {
+			level.Error(logger).Log("msg", "Lost the connection of the persistent probe", "target", probe.Target)
+			closeConn()
+		}
+		if conn == nil {
+			if conn = s.connectPersistent(sp.ctx, probe, logger); conn != nil {
+				if connects++; connects > 1 {
+					s.reconnectCounter.WithLabelValues(probe.Target).Inc()
+				}
+				stopReceive = make(chan struct{})
+				go s.receivePersistent(probe.Target, conn, tracker, stopReceive)
+			}
+		}
+
+		if conn != nil {
+			seq, payload := tracker.next()
+			s.publishedCounter.WithLabelValues(probe.Target).Inc()
+			if err := conn.publish(sp.ctx, probe, payload); err != nil {
+				// The publish abandoned by the stop isn't counted.
+				if sp.ctx.Err() != nil {
+					return
+				}
+				level.Error(logger).Log("msg", "Failed to publish MQTT message", "target", probe.Target, "topic", probe.Topic, "seq", seq, "err", err)
+				s.failureCounter.WithLabelValues(probe.Target, config.ProbeModulePubSub, phasePublish).Inc()
+				closeConn()
+			}
+		}
+		if lost := tracker.expire(time.Now()); lost > 0 {
+			level.Debug(logger).Log("msg", "MQTT probe messages lost", "target", probe.Target, "lost", lost)
+			s.lostCounter.WithLabelValues(probe.Target).Add(float64(lost))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sp.ctx.Done():
+			return
+		}
+	}
+}
+
+// connectPersistent connects to the target and subscribes to the topic of the probe, the failure
+// is counted by the phase. It returns nil if it fails.
+func (s *Scheduler) connectPersistent(ctx context.Context, probe config.Probe, logger log.Logger) persistentConn {
+	trace := newProbeTrace()
+	if probe.ProtocolVersion == 5 {
+		if mp := newMQTT5Probe(ctx, probe, trace, logger); mp != nil {
+			return mp
+		}
+	} else {
+		if mp := newMQTTProbe(ctx, probe, trace, logger); mp != nil {
+			return mp
+		}
+	}
+	// The connection abandoned by the stop isn't counted.
+	if ctx.Err() == nil {
+		s.failureCounter.WithLabelValues(probe.Target, config.ProbeModulePubSub, trace.failedPhase()).Inc()
+	}
+	return nil
+}
+
+// receivePersistent tracks the messages received from the connection until stop is closed.
+func (s *Scheduler) receivePersistent(target string, conn persistentConn, tracker *sequenceTracker, stop <-chan struct{}) {
+	for {
+		payload, _, ok := conn.receive(stop)
+		if !ok {
+			return
+		}
+		switch delivery, roundtrip := tracker.receive(payload, time.Now()); delivery {
+		case deliveryInOrder, deliveryOutOfOrder:
+			s.deliveredCounter.WithLabelValues(target).Inc()
+			s.roundtripHistogram.WithLabelValues(target, config.ProbeModulePubSub).Observe(roundtrip.Seconds())
+			if delivery == deliveryOutOfOrder {
+				s.outOfOrderCounter.WithLabelValues(target).Inc()
+			}
+		case deliveryDuplicate:
+			s.duplicateCounter.WithLabelValues(target).Inc()
+		}
+	}
+}
+
+// newRunID returns a random ID of the run of a probe, so that the messages published by former runs,
+// or by other exporters with the same config, aren't taken as the messages of this run.
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// delivery is how a message received by the persistent probe was delivered.
+type delivery int
+
+const (
+	// deliveryUnknown is a message which isn't published by the run, or which has been taken as lost.
+	deliveryUnknown delivery = iota
+	deliveryInOrder
+	// deliveryOutOfOrder is a message received after a message published later.
+	deliveryOutOfOrder
+	// deliveryDuplicate is a message which has been received before.
+	deliveryDuplicate
+)
+
+// sequenceTracker numbers the messages of the persistent probe and tracks their delivery. The messages which
+// haven't been received within the timeout are taken as lost, even if they're received later.
+type sequenceTracker struct {
+	runID   string
+	timeout time.Duration
+
+	mtx     sync.Mutex
+	seq     uint64
+	highest uint64
+	// pending are the publish times of the messages which haven't been received.
+	pending map[uint64]time.Time
+	// received are the publish times of the received messages, kept for the timeout to detect duplicates.
+	received map[uint64]time.Time
+}
+
+func newSequenceTracker(runID string, timeout time.Duration) *sequenceTracker {
+	return &sequenceTracker{
+		runID:    runID,
+		timeout:  timeout,
+		pending:  make(map[uint64]time.Time),
+		received: make(map[uint64]time.Time),
+	}
+}
+
+// next returns the sequence number and the payload of the next message, which is pending from now on.
+func (t *sequenceTracker) next() (uint64, []byte) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.seq++
+	t.pending[t.seq] = time.Now()
+	return t.seq, []byte(probeMessage + " " + t.runID + " " + strconv.FormatUint(t.seq, 10))
+}
+
+// receive tracks the message of the payload received at now, and returns how it was delivered and its roundtrip.
+func (t *sequenceTracker) receive(payload []byte, now time.Time) (delivery, time.Duration) {
+	seq, ok := t.parse(payload)
+	if !ok {
+		return deliveryUnknown, 0
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.received[seq]; ok {
+		return deliveryDuplicate, 0
+	}
+	published, ok := t.pending[seq]
+	if !ok {
+		return deliveryUnknown, 0
+	}
+	delete(t.pending, seq)
+	t.received[seq] = published
+
+	if seq < t.highest {
+		return deliveryOutOfOrder, now.Sub(published)
+	}
+	t.highest = seq
+	return deliveryInOrder, now.Sub(published)
+}
+
+// expire takes the pending messages published before the timeout as lost and returns the number of them.
+// The received messages are forgotten after the timeout too.
+func (t *sequenceTracker) expire(now time.Time) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	lost := 0
+	for seq, published := range t.pending {
+		if now.Sub(published) > t.timeout {
+			delete(t.pending, seq)
+			lost++
+		}
+	}
+	for seq, published := range t.received {
+		if now.Sub(published) > t.timeout {
+			delete(t.received, seq)
+		}
+	}
+	return lost
+}
+
+func (t *sequenceTracker) parse(payload []byte) (uint64, bool) {
+	fields := strings.Fields(strings.TrimPrefix(string(payload), probeMessage))
+	if len(fields) != 2 || fields[0] != t.runID {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	return seq, err == nil
+}
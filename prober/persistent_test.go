@@ -0,0 +1,127 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+	"emqx-exporter/prober/mqtttest"
+
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	tracker := newSequenceTracker("run", time.Second)
+	payloads := make(map[uint64][]byte)
+	for i := 0; i < 3; i++ {
+		seq, payload := tracker.next()
+		payloads[seq] = payload
+	}
+
+	now := time.Now()
+	steps := []struct {
+		name     string
+		payload  []byte
+		expected delivery
+	}{
+		{name: "first", payload: payloads[1], expected: deliveryInOrder},
+		{name: "third", payload: payloads[3], expected: deliveryInOrder},
+		{name: "second after third", payload: payloads[2], expected: deliveryOutOfOrder},
+		{name: "second again", payload: payloads[2], expected: deliveryDuplicate},
+		{name: "probe message", payload: []byte(probeMessage), expected: deliveryUnknown},
+		{name: "other run", payload: []byte(probeMessage + " other 4"), expected: deliveryUnknown},
+		{name: "not published", payload: []byte(probeMessage + " run 4"), expected: deliveryUnknown},
+	}
+	for _, step := range steps {
+		got, roundtrip := tracker.receive(step.payload, now)
+		if got != step.expected {
+			t.Errorf("%s: expected the delivery %d but got %d", step.name, step.expected, got)
+		}
+		if (got == deliveryInOrder || got == deliveryOutOfOrder) && roundtrip < 0 {
+			t.Errorf("%s: unexpected roundtrip %s", step.name, roundtrip)
+		}
+	}
+
+	seq, payload := tracker.next()
+	if lost := tracker.expire(time.Now()); lost != 0 {
+		t.Errorf("Expected no message lost within the timeout but got %d", lost)
+	}
+	if lost := tracker.expire(time.Now().Add(2 * time.Second)); lost != 1 {
+		t.Errorf("Expected the message %d lost after the timeout but got %d", seq, lost)
+	}
+	if got, _ := tracker.receive(payload, time.Now()); got != deliveryUnknown {
+		t.Errorf("Expected the lost message to be unknown when it's received late but got %d", got)
+	}
+	if got, _ := tracker.receive(payloads[1], time.Now()); got != deliveryUnknown {
+		t.Errorf("Expected the received messages to be forgotten after the timeout but got %d", got)
+	}
+}
+
+// counterValue returns the value of the counter of the target, 0 if it's absent.
+func counterValue(metrics map[string][]*dto.Metric, name, target string) float64 {
+	for _, m := range metrics[name] {
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "target" && label.GetValue() == target {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestSchedulerPersistent(t *testing.T) {
+	for _, protocolVersion := range []uint{4, 5} {
+		broker := mqtttest.NewBroker()
+		defer broker.Close()
+
+		registry := prometheus.NewRegistry()
+		scheduler := NewScheduler(registry, log.NewNopLogger())
+		defer scheduler.Stop()
+
+		probe := broker.Probe("tcp")
+		probe.ProtocolVersion = protocolVersion
+		probe.QoS = 1
+		probe.Interval = 1
+		probe.Persistent = true
+		// The broker closes the connections which are idle for the keep alive of 1 second,
+		// which is as long as the interval.
+		probe.KeepAlive = 2
+		scheduler.Reload([]config.Probe{probe})
+
+		waitMetric(t, registry, "the delivered messages", func(metrics map[string][]*dto.Metric) bool {
+			return counterValue(metrics, "emqx_mqtt_probe_messages_delivered_total", probe.Target) >= 2
+		})
+		metrics := gatherMetrics(t, registry)
+		if connected := broker.Connected(); connected != 1 {
+			t.Errorf("Expected the persistent probe to keep one connection but got %d", connected)
+		}
+		for _, name := range []string{"emqx_mqtt_probe_messages_lost_total", "emqx_mqtt_probe_messages_duplicated_total",
+			"emqx_mqtt_probe_messages_out_of_order_total", "emqx_mqtt_probe_reconnects_total"} {
+			if v := counterValue(metrics, name, probe.Target); v != 0 {
+				t.Errorf("Expected %s 0 but got %v", name, v)
+			}
+		}
+		if published := counterValue(metrics, "emqx_mqtt_probe_messages_published_total", probe.Target); published < 2 {
+			t.Errorf("Expected the published messages to be counted but got %v", published)
+		}
+
+		broker.DisconnectAll()
+		waitMetric(t, registry, "the reconnect", func(metrics map[string][]*dto.Metric) bool {
+			return counterValue(metrics, "emqx_mqtt_probe_reconnects_total", probe.Target) >= 1
+		})
+
+		broker.DropPublish()
+		waitMetric(t, registry, "the lost messages", func(metrics map[string][]*dto.Metric) bool {
+			return counterValue(metrics, "emqx_mqtt_probe_messages_lost_total", probe.Target) >= 1
+		})
+		broker.Reset()
+
+		scheduler.Reload(nil)
+		if metrics := gatherMetrics(t, registry); len(metrics) != 0 {
+			t.Errorf("Expected the metrics of the removed probe to be deleted but got %v", metrics)
+		}
+		waitDisconnected(t, broker)
+	}
+}
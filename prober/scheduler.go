@@ -0,0 +1,225 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backgroundClientIDSuffix is appended to the client ID of the background probes, so that they don't take over
+// the connections of the probes on /probe.
+const backgroundClientIDSuffix = "-background"
+
+// backgroundTopicSuffix is appended to the topic of the background probes, so that their messages aren't
+// received by the probes on /probe, nor replace their retained messages.
+const backgroundTopicSuffix = "/background"
+
+// Scheduler probes the targets which have an interval in the background, and accumulates the results in
+// the histogram of the roundtrip and the counters of successes and failures. The persistent probes also
+// count the published messages by how they were delivered, and the reconnects.
+type Scheduler struct {
+	logger log.Logger
+
+	roundtripHistogram *prometheus.HistogramVec
+	successCounter     *prometheus.CounterVec
+	failureCounter     *prometheus.CounterVec
+	publishedCounter   *prometheus.CounterVec
+	deliveredCounter   *prometheus.CounterVec
+	lostCounter        *prometheus.CounterVec
+	duplicateCounter   *prometheus.CounterVec
+	outOfOrderCounter  *prometheus.CounterVec
+	reconnectCounter   *prometheus.CounterVec
+
+	mtx    sync.Mutex
+	probes map[scheduledKey]*scheduledProbe
+}
+
+// scheduledKey identifies the background probe, as the modules of a target are probed separately.
+type scheduledKey struct {
+	target string
+	module string
+}
+
+// scheduledProbe is the probe running in the background, it's stopped by canceling ctx, which also
+// abandons the running probe.
+type scheduledProbe struct {
+	probe  config.Probe
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewScheduler creates a Scheduler whose metrics are registered by reg.
+func NewScheduler(reg prometheus.Registerer, logger log.Logger) *Scheduler {
+	s := &Scheduler{
+		logger: logger,
+		roundtripHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "emqx",
+			Subsystem: "mqtt",
+			Name:      "probe_roundtrip_seconds",
+			Help:      "Histogram of the roundtrip of the successful background probes, or of the messages delivered to the persistent probes, in seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, []string{"target", "module"}),
+		successCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "emqx",
+			Subsystem: "mqtt",
+			Name:      "probe_success_total",
+			Help:      "Total number of the successful background probes",
+		}, []string{"target", "module"}),
+		failureCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "emqx",
+			Subsystem: "mqtt",
+			Name:      "probe_failures_total",
+			Help:      "Total number of the failed background probes, or of the failed connections and publishes of the persistent probes, by the phase in which they failed",
+		}, []string{"target", "module", "phase"}),
+		publishedCounter:  newMessageCounterVec("published", "Total number of the messages published by the persistent probe"),
+		deliveredCounter:  newMessageCounterVec("delivered", "Total number of the messages delivered to the persistent probe, including the ones out of order"),
+		lostCounter:       newMessageCounterVec("lost", "Total number of the messages which haven't been delivered to the persistent probe within the keep alive"),
+		duplicateCounter:  newMessageCounterVec("duplicated", "Total number of the messages delivered to the persistent probe more than once"),
+		outOfOrderCounter: newMessageCounterVec("out_of_order", "Total number of the messages delivered to the persistent probe after a message published later"),
+		reconnectCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "emqx",
+			Subsystem: "mqtt",
+			Name:      "probe_reconnects_total",
+			Help:      "Total number of the times the persistent probe reconnected after it lost the connection",
+		}, []string{"target"}),
+		probes: make(map[scheduledKey]*scheduledProbe),
+	}
+	if reg != nil {
+		reg.MustRegister(s.roundtripHistogram, s.successCounter, s.failureCounter, s.publishedCounter, s.deliveredCounter,
+			s.lostCounter, s.duplicateCounter, s.outOfOrderCounter, s.reconnectCounter)
+	}
+	return s
+}
+
+func newMessageCounterVec(name, help string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "emqx",
+		Subsystem: "mqtt",
+		Name:      "probe_messages_" + name + "_total",
+		Help:      help,
+	}, []string{"target"})
+}
+
+// Reload applies the probes. The background probes whose config has changed or which have been
+// removed are stopped, and the probes which have an interval are started if they aren't running.
+// The stopped probes are canceled together, and the new ones start once they have returned, so
+// that a probe never runs alongside the former one with the same client ID.
+func (s *Scheduler) Reload(probes []config.Probe) {
+	scheduled := make(map[scheduledKey]config.Probe, len(probes))
+	for _, probe := range probes {
+		if probe.Interval > 0 {
+			scheduled[scheduledKey{probe.Target, probeModule(probe)}] = probe
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var stopped []*scheduledProbe
+	for key, sp := range s.probes {
+		if probe, ok := scheduled[key]; ok && reflect.DeepEqual(probe, sp.probe) {
+			continue
+		}
+		level.Info(s.logger).Log("msg", "Stopping the background probe", "target", key.target, "module", key.module)
+		sp.cancel()
+		stopped = append(stopped, sp)
+		delete(s.probes, key)
+	}
+	for _, sp := range stopped {
+		<-sp.done
+	}
+	for key := range s.probes {
+		delete(scheduled, key)
+	}
+	// The metrics are deleted after the stopped probes have returned, so that they aren't recreated by them.
+	for _, sp := range stopped {
+		key := scheduledKey{sp.probe.Target, probeModule(sp.probe)}
+		if _, ok := scheduled[key]; !ok {
+			s.deleteMetrics(key)
+		}
+	}
+
+	for key, probe := range scheduled {
+		level.Info(s.logger).Log("msg", "Starting the background probe", "target", key.target, "module", key.module, "interval", probe.Interval)
+		sp := &scheduledProbe{
+			probe: probe,
+			done:  make(chan struct{}),
+		}
+		sp.ctx, sp.cancel = context.WithCancel(context.Background())
+		s.probes[key] = sp
+		if probe.Persistent {
+			go s.runPersistent(sp)
+		} else {
+			go s.run(sp)
+		}
+	}
+}
+
+// Stop stops all background probes and waits for them to return.
+func (s *Scheduler) Stop() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, sp := range s.probes {
+		sp.cancel()
+	}
+	for key, sp := range s.probes {
+		<-sp.done
+		delete(s.probes, key)
+	}
+}
+
+// run probes the target immediately and then at every interval until the probe is stopped.
+func (s *Scheduler) run(sp *scheduledProbe) {
+	defer close(sp.done)
+
+	probe := sp.probe
+	probe.ClientID += backgroundClientIDSuffix
+	probe.Topic += backgroundTopicSuffix
+	module := probeModule(probe)
+	logger := log.With(s.logger, "background", true)
+	ticker := time.NewTicker(time.Duration(probe.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		success, trace := probeOnce(sp.ctx, probe, logger)
+		// The probe abandoned by the stop isn't counted.
+		if sp.ctx.Err() != nil {
+			return
+		}
+		if success {
+			s.successCounter.WithLabelValues(probe.Target, module).Inc()
+			// The probe expecting a rejection has no roundtrip.
+			if probe.Expect == "" {
+				s.roundtripHistogram.WithLabelValues(probe.Target, module).Observe(trace.duration(phaseRoundtrip).Seconds())
+			}
+		} else {
+			s.failureCounter.WithLabelValues(probe.Target, module, trace.failedPhase()).Inc()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sp.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Scheduler) deleteMetrics(key scheduledKey) {
+	s.roundtripHistogram.DeleteLabelValues(key.target, key.module)
+	s.successCounter.DeleteLabelValues(key.target, key.module)
+	s.failureCounter.DeletePartialMatch(prometheus.Labels{"target": key.target, "module": key.module})
+	// The persistent probes are only of the module pubsub.
+	if key.module == config.ProbeModulePubSub {
+		for _, c := range []*prometheus.CounterVec{s.publishedCounter, s.deliveredCounter, s.lostCounter,
+			s.duplicateCounter, s.outOfOrderCounter, s.reconnectCounter} {
+			c.DeleteLabelValues(key.target)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+	"emqx-exporter/prober/mqtttest"
+
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherMetrics returns the metrics gathered from the registry keyed by the name of the metric family.
+func gatherMetrics(t *testing.T, registry *prometheus.Registry) map[string][]*dto.Metric {
+	t.Helper()
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string][]*dto.Metric, len(mfs))
+	for _, mf := range mfs {
+		metrics[mf.GetName()] = mf.GetMetric()
+	}
+	return metrics
+}
+
+// waitMetric waits for the condition on the gathered metrics to be true.
+func waitMetric(t *testing.T, registry *prometheus.Registry, what string, cond func(metrics map[string][]*dto.Metric) bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond(gatherMetrics(t, registry)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s, got %v", what, gatherMetrics(t, registry))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	registry := prometheus.NewRegistry()
+	scheduler := NewScheduler(registry, log.NewNopLogger())
+	defer scheduler.Stop()
+
+	probe := broker.Probe("tcp")
+	probe.Interval = 1
+	unscheduled := broker.Probe("ws")
+	scheduler.Reload([]config.Probe{probe, unscheduled})
+
+	waitMetric(t, registry, "the successful probe", func(metrics map[string][]*dto.Metric) bool {
+		success := metrics["emqx_mqtt_probe_success_total"]
+		return len(success) == 1 && success[0].GetCounter().GetValue() >= 1
+	})
+	metrics := gatherMetrics(t, registry)
+	roundtrip := metrics["emqx_mqtt_probe_roundtrip_seconds"]
+	if len(roundtrip) != 1 {
+		t.Fatalf("Expected the roundtrip histogram of the scheduled probe only but got %v", roundtrip)
+	}
+	if h := roundtrip[0].GetHistogram(); h.GetSampleCount() < 1 || h.GetSampleSum() <= 0 {
+		t.Errorf("Expected the roundtrip to be observed but got %v", h)
+	}
+	for _, label := range roundtrip[0].GetLabel() {
+		if label.GetName() == "target" && label.GetValue() != probe.Target {
+			t.Errorf("Expected the target %s but got %s", probe.Target, label.GetValue())
+		}
+	}
+
+	broker.DenySubscribe()
+	waitMetric(t, registry, "the failed probe", func(metrics map[string][]*dto.Metric) bool {
+		for _, m := range metrics["emqx_mqtt_probe_failures_total"] {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "phase" && label.GetValue() == phaseSubscribe {
+					return m.GetCounter().GetValue() >= 1
+				}
+			}
+		}
+		return false
+	})
+	broker.Reset()
+
+	scheduler.Reload([]config.Probe{unscheduled})
+	if metrics := gatherMetrics(t, registry); len(metrics) != 0 {
+		t.Errorf("Expected the metrics of the removed probe to be deleted but got %v", metrics)
+	}
+	waitDisconnected(t, broker)
+}
+
+func TestSchedulerUnexpectedSuccess(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	registry := prometheus.NewRegistry()
+	scheduler := NewScheduler(registry, log.NewNopLogger())
+	defer scheduler.Stop()
+
+	probe := broker.Probe("tcp")
+	probe.Interval = 1
+	probe.Expect = config.ProbeExpectConnectRefused
+	scheduler.Reload([]config.Probe{probe})
+
+	waitMetric(t, registry, "the failure of the probe which wasn't rejected", func(metrics map[string][]*dto.Metric) bool {
+		for _, m := range metrics["emqx_mqtt_probe_failures_total"] {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "phase" && label.GetValue() == phaseExpect {
+					return m.GetCounter().GetValue() >= 1
+				}
+			}
+		}
+		return false
+	})
+	scheduler.Stop()
+	waitDisconnected(t, broker)
+}
+
+func TestSchedulerIsolatedFromProbeHandler(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	registry := prometheus.NewRegistry()
+	scheduler := NewScheduler(registry, log.NewNopLogger())
+	defer scheduler.Stop()
+
+	probe := broker.Probe("tcp")
+	probe.Interval = 1
+	scheduler.Reload([]config.Probe{probe})
+
+	// The probes on /probe run while the background probe is probing the same target.
+	for i := 0; i < 3; i++ {
+		mfs := runProbe(t, []config.Probe{probe}, probe.Target)
+		if got := gaugeValues(t, mfs["emqx_mqtt_probe_success"], probe.Target)[""]; got != 1 {
+			t.Errorf("Expected the probe on /probe to succeed but got %v", got)
+		}
+	}
+	waitMetric(t, registry, "the successful background probe", func(metrics map[string][]*dto.Metric) bool {
+		success := metrics["emqx_mqtt_probe_success_total"]
+		return len(success) == 1 && success[0].GetCounter().GetValue() >= 1
+	})
+
+	for _, clientID := range broker.Publishers(probe.Topic) {
+		if strings.Contains(clientID, backgroundClientIDSuffix) {
+			t.Errorf("Expected the background probe not to publish on the topic of /probe, but %s did", clientID)
+		}
+	}
+	if len(broker.Publishers(probe.Topic+backgroundTopicSuffix)) == 0 {
+		t.Errorf("Expected the background probe to publish on %s", probe.Topic+backgroundTopicSuffix)
+	}
+	scheduler.Stop()
+	waitDisconnected(t, broker)
+}
+
+func TestSchedulerStopAbandonsRunningProbe(t *testing.T) {
+	tests := []struct {
+		name            string
+		protocolVersion uint
+		qos             byte
+		stop            func(s *Scheduler)
+	}{
+		{name: "reload", stop: func(s *Scheduler) { s.Reload(nil) }},
+		{name: "stop", stop: (*Scheduler).Stop},
+		{name: "mqtt5 reload", protocolVersion: 5, stop: func(s *Scheduler) { s.Reload(nil) }},
+		{name: "qos1 stop", qos: 1, stop: (*Scheduler).Stop},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			broker := mqtttest.NewBroker()
+			defer broker.Close()
+			broker.DropPublish()
+
+			scheduler := NewScheduler(prometheus.NewRegistry(), log.NewNopLogger())
+			defer scheduler.Stop()
+
+			// The probe waits for the dropped message for the keep alive, which is longer than the test.
+			probe := broker.Probe("tcp")
+			probe.Interval = 1
+			probe.KeepAlive = 600
+			probe.ProtocolVersion = tc.protocolVersion
+			probe.QoS = tc.qos
+			scheduler.Reload([]config.Probe{probe})
+
+			deadline := time.Now().Add(10 * time.Second)
+			for broker.Publishes() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("Timed out waiting for the background probe to publish")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			start := time.Now()
+			tc.stop(scheduler)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Expected the running probe to be abandoned on %s but it took %s", tc.name, elapsed)
+			}
+			waitDisconnected(t, broker)
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+
+	"context"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// sessionResumeTarget returns the target the subscriber of the session probe reconnects to.
+func sessionResumeTarget(probe config.Probe) string {
+	if probe.ResumeTarget != "" {
+		return probe.ResumeTarget
+	}
+	_, subscribeTarget := probeTargets(probe)
+	return subscribeTarget
+}
+
+// probeSession subscribes with a persistent session and disconnects, publishes the messages of the probe while
+// the subscriber is offline, then resumes the session and checks that the queued messages are delivered.
+// The session is discarded at last by connecting with a clean session, as MQTT 3 has no session expiry.
+func probeSession(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	_, subscribeTarget := probeTargets(probe)
+	resumeTarget := sessionResumeTarget(probe)
+	queue := newSessionQueue(newRunID(), probe.SessionMessages)
+	trace.session = queue
+
+	opt := clientOptions(ctx, probe, subscribeTarget, probe.ClientID, trace, logger)
+	opt.SetCleanSession(false)
+	c := connect(opt, subscribeTarget, trace, logger)
+	if c == nil {
+		return false
+	}
+	defer discardSession(ctx, probe, resumeTarget, logger)
+	start := time.Now()
+	err := subscribeError(c.Subscribe(probe.Topic, probe.QoS, nil), trace)
+	trace.observe(phaseSubscribe, start)
+	c.Disconnect(0)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to subscribe to MQTT topic", "target", subscribeTarget, "topic", probe.Topic, "qos", probe.QoS, "err", err)
+		trace.fail(phaseSubscribe)
+		return false
+	}
+
+	if !publishQueued(ctx, probe, queue, trace, logger) {
+		return false
+	}
+
+	// The queued messages are delivered before the client subscribes, so they're received by the default handler.
+	msgChan := make(chan mqtt.Message, messageBuffer)
+	opt = clientOptions(ctx, probe, resumeTarget, probe.ClientID, trace, logger)
+	opt.SetCleanSession(false)
+	opt.SetDefaultPublishHandler(func(c mqtt.Client, m mqtt.Message) {
+		select {
+		case msgChan <- m:
+		default:
+		}
+	})
+	start = time.Now()
+	c, present := connectSession(opt, resumeTarget, trace, logger)
+	if c == nil {
+		return false
+	}
+	defer c.Disconnect(0)
+	return waitQueued(ctx, probe, &MQTTProbe{Client: c, MsgChan: msgChan, Publisher: c, trace: trace}, queue, present, trace, start, logger)
+}
+
+// discardSession connects to the target with a clean session to discard the session of the probe.
+func discardSession(ctx context.Context, probe config.Probe, target string, logger log.Logger) {
+	// The connection isn't a part of the probe, so it's traced separately.
+	trace := newProbeTrace()
+	c := connect(clientOptions(ctx, probe, target, probe.ClientID, trace, logger), target, trace, logger)
+	if c == nil {
+		level.Warn(logger).Log("msg", "Failed to discard the MQTT session", "target", target, "client_id", probe.ClientID)
+		return
+	}
+	c.Disconnect(0)
+}
+
+// probeSession5 is probeSession of MQTT 5. The session expires after the keep alive unless the session expiry
+// interval of the probe is set, and it's discarded at last by the session expiry interval 0 of DISCONNECT.
+func probeSession5(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	if probe.SessionExpiryInterval == 0 {
+		probe.SessionExpiryInterval = uint32(probe.KeepAlive)
+	}
+	resumeTarget := sessionResumeTarget(probe)
+	queue := newSessionQueue(newRunID(), probe.SessionMessages)
+	trace.session = queue
+
+	mp := newMQTT5Probe(ctx, subscriberProbe(probe), trace, logger)
+	if mp == nil {
+		return false
+	}
+	mp.disconnect()
+
+	if !publishQueued(ctx, probe, queue, trace, logger) {
+		return false
+	}
+
+	msgChan := make(chan *paho.Publish, messageBuffer)
+	resumed := &MQTT5Probe{MsgChan: msgChan, trace: trace, resume: true}
+	start := time.Now()
+	c, ca, _ := resumed.connect(ctx, probe, resumeTarget, probe.ClientID, func(pr paho.PublishReceived) (bool, error) {
+		select {
+		case msgChan <- pr.Packet:
+		default:
+		}
+		return true, nil
+	}, nil, logger)
+	if c == nil {
+		return false
+	}
+	resumed.Client, resumed.Publisher = c, c
+	defer func() {
+		var expiry uint32
+		resumed.closed.Store(true)
+		_ = c.Disconnect(&paho.Disconnect{ReasonCode: 0, Properties: &paho.DisconnectProperties{SessionExpiryInterval: &expiry}})
+	}()
+	return waitQueued(ctx, probe, resumed, queue, ca.SessionPresent, trace, start, logger)
+}
+
+// publishQueued publishes the messages of the queue to the topic of the probe by the publisher of the probe.
+func publishQueued(ctx context.Context, probe config.Probe, queue *sessionQueue, trace *probeTrace, logger log.Logger) bool {
+	publisher := connectPublisher(ctx, probe, trace, logger)
+	if publisher == nil {
+		return false
+	}
+	defer publisher.disconnect()
+
+	for seq := 0; seq < queue.messages; seq++ {
+		start := time.Now()
+		err := publisher.publish(ctx, probe, queue.payload(seq))
+		trace.observe(phasePublish, start)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to publish MQTT message", "target", probe.Target, "topic", probe.Topic, "qos", probe.QoS, "seq", seq, "err", err)
+			trace.fail(phasePublish)
+			return false
+		}
+	}
+	return true
+}
+
+// waitQueued waits for the queued messages for the keep alive after the session is resumed or until ctx is done,
+// and records the roundtrip since start, i.e. from reconnecting to the delivery of the last queued message.
+func waitQueued(ctx context.Context, probe config.Probe, mp messageReceiver, queue *sessionQueue, present bool, trace *probeTrace, start time.Time, logger log.Logger) bool {
+	queue.resume(present)
+	if present {
+		ctx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+		defer cancel()
+		for queue.deliveredMessages() < queue.messages {
+			payload, _, ok := mp.receive(ctx.Done())
+			if !ok {
+				break
+			}
+			queue.receive(payload)
+		}
+	}
+	trace.observe(phaseRoundtrip, start)
+
+	if !present {
+		level.Error(logger).Log("msg", "MQTT probe session isn't present after reconnecting", "target", probe.Target, "client_id", probe.ClientID)
+		trace.fail(phaseRoundtrip)
+		return false
+	}
+	if delivered := queue.deliveredMessages(); delivered < queue.messages {
+		level.Error(logger).Log("msg", "MQTT probe queued messages missing", "target", probe.Target, "delivered", delivered, "queued", queue.messages)
+		trace.fail(phaseRoundtrip)
+		return false
+	}
+	level.Debug(logger).Log("msg", "MQTT probe queued messages delivered", "target", probe.Target, "delivered", queue.messages)
+	return true
+}
+
+// sessionQueue records the messages published while the subscriber of the session probe is offline,
+// and their delivery after it resumes the session.
+type sessionQueue struct {
+	runID    string
+	messages int
+
+	mtx       sync.Mutex
+	present   bool
+	delivered map[int]struct{}
+}
+
+func newSessionQueue(runID string, messages int) *sessionQueue {
+	return &sessionQueue{
+		runID:     runID,
+		messages:  messages,
+		delivered: make(map[int]struct{}, messages),
+	}
+}
+
+// payload returns the payload of the message of the sequence number.
+func (q *sessionQueue) payload(seq int) []byte {
+	return seqPayload(config.ProbeModuleSession, q.runID, seq)
+}
+
+// resume records whether the session was present when the subscriber reconnected.
+func (q *sessionQueue) resume(present bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.present = present
+}
+
+// receive records the delivery of the message of the payload, the messages which aren't queued are skipped.
+func (q *sessionQueue) receive(payload []byte) {
+	seq, ok := parseSeqPayload(payload, config.ProbeModuleSession, q.runID)
+	if !ok || seq >= q.messages {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.delivered[seq] = struct{}{}
+}
+
+func (q *sessionQueue) sessionPresent() bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.present
+}
+
+// deliveredMessages returns the number of the queued messages which have been delivered.
+func (q *sessionQueue) deliveredMessages() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.delivered)
+}
@@ -0,0 +1,237 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// sharedConn is a connection of the shared probe, it's implemented by MQTTProbe and MQTT5Probe.
+type sharedConn interface {
+	messageReceiver
+	publish(ctx context.Context, probe config.Probe, payload []byte) error
+	disconnect()
+}
+
+// sharedSubscriberProbe returns the probe of the subscriber of the index in the shared group.
+func sharedSubscriberProbe(probe config.Probe, index int) config.Probe {
+	probe = subscriberProbe(probe)
+	probe.ClientID += "-shared-" + strconv.Itoa(index)
+	probe.Topic = "$share/" + probe.SharedGroup + "/" + probe.Topic
+	return probe
+}
+
+// probeShared subscribes to the topic in the shared group by the subscribers of the probe, publishes the messages
+// of the probe and records how they're distributed by the trace. The roundtrip phase is from the first publish to
+// the delivery of the last message, the probe fails if any message is missing or delivered more than once.
+func probeShared(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) bool {
+	publishTarget, _ := probeTargets(probe)
+	dist := newSharedDistribution(newRunID(), probe.SharedSubscribers, probe.SharedMessages)
+	trace.shared = dist
+
+	subscribers := make([]sharedConn, 0, probe.SharedSubscribers)
+	defer func() {
+		for _, sub := range subscribers {
+			sub.disconnect()
+		}
+	}()
+	for i := 0; i < probe.SharedSubscribers; i++ {
+		sub := newSharedConn(ctx, sharedSubscriberProbe(probe, i), trace, logger)
+		if sub == nil {
+			return false
+		}
+		subscribers = append(subscribers, sub)
+	}
+
+	publisher := connectPublisher(ctx, probe, trace, logger)
+	if publisher == nil {
+		return false
+	}
+	defer publisher.disconnect()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, sub := range subscribers {
+		wg.Add(1)
+		go func(i int, sub sharedConn) {
+			defer wg.Done()
+			for {
+				payload, _, ok := sub.receive(stop)
+				if !ok {
+					return
+				}
+				dist.receive(i, payload, time.Now())
+			}
+		}(i, sub)
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	start := time.Now()
+	for seq := 0; seq < probe.SharedMessages; seq++ {
+		payload := dist.publish(seq, time.Now())
+		publishStart := time.Now()
+		err := publisher.publish(ctx, probe, payload)
+		trace.observe(phasePublish, publishStart)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to publish MQTT message", "target", publishTarget, "topic", probe.Topic, "qos", probe.QoS, "seq", seq, "err", err)
+			trace.fail(phasePublish)
+			return false
+		}
+	}
+
+	waitCtx, cancel := timeoutContext(ctx, time.Duration(probe.KeepAlive)*time.Second)
+	defer cancel()
+	select {
+	case <-dist.done:
+	case <-waitCtx.Done():
+	}
+	trace.observe(phaseRoundtrip, start)
+	if missing, duplicated := dist.missing(), dist.duplicatedMessages(); missing > 0 || duplicated > 0 {
+		level.Error(logger).Log("msg", "MQTT probe shared subscription failed", "target", probe.Target, "group", probe.SharedGroup, "missing", missing, "duplicated", duplicated)
+		trace.fail(phaseRoundtrip)
+		return false
+	}
+	level.Debug(logger).Log("msg", "MQTT probe shared subscription success", "target", probe.Target, "group", probe.SharedGroup, "received", dist.receivedMessages())
+	return true
+}
+
+// newSharedConn connects the subscriber of the shared group by the protocol version of the probe,
+// it returns nil if it fails.
+func newSharedConn(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) sharedConn {
+	if probe.ProtocolVersion == 5 {
+		if mp := newMQTT5Probe(ctx, probe, trace, logger); mp != nil {
+			return mp
+		}
+		return nil
+	}
+	if mp := newMQTTProbe(ctx, probe, trace, logger); mp != nil {
+		return mp
+	}
+	return nil
+}
+
+// connectPublisher connects the publisher of the probe to the publish target by the protocol version of the probe,
+// it returns nil if it fails.
+func connectPublisher(ctx context.Context, probe config.Probe, trace *probeTrace, logger log.Logger) sharedConn {
+	publishTarget, _ := probeTargets(probe)
+	if probe.ProtocolVersion == 5 {
+		mp := &MQTT5Probe{trace: trace}
+		if c, _, _ := mp.connect(ctx, probe, publishTarget, publisherClientID(probe), nil, nil, logger); c != nil {
+			mp.Client, mp.Publisher = c, c
+			return mp
+		}
+		return nil
+	}
+	opt := clientOptions(ctx, probe, publishTarget, publisherClientID(probe), trace, logger)
+	if c := connect(opt, publishTarget, trace, logger); c != nil {
+		return &MQTTProbe{Client: c, Publisher: c, trace: trace}
+	}
+	return nil
+}
+
+// sharedDistribution records the messages of the shared probe received by every subscriber and their latency.
+type sharedDistribution struct {
+	runID    string
+	messages int
+	// done is closed once all messages have been received.
+	done chan struct{}
+
+	mtx sync.Mutex
+	// published are the publish times of the messages, keyed by the sequence number.
+	published map[int]time.Time
+	// delivered are the messages received by any subscriber, and received are the numbers of
+	// the messages received by every subscriber, including the duplicates.
+	delivered  map[int]struct{}
+	received   []int
+	duplicated int
+	// latencySum and latencyMax are of the first delivery of every message.
+	latencySum time.Duration
+	latencyMax time.Duration
+}
+
+func newSharedDistribution(runID string, subscribers, messages int) *sharedDistribution {
+	return &sharedDistribution{
+		runID:     runID,
+		messages:  messages,
+		done:      make(chan struct{}),
+		published: make(map[int]time.Time, messages),
+		delivered: make(map[int]struct{}, messages),
+		received:  make([]int, subscribers),
+	}
+}
+
+// publish records the message of the sequence number published at now and returns its payload.
+func (d *sharedDistribution) publish(seq int, now time.Time) []byte {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.published[seq] = now
+	return seqPayload(config.ProbeModuleShared, d.runID, seq)
+}
+
+// receive records the message of the payload received by the subscriber at now, the messages
+// which aren't published by the probe are skipped.
+func (d *sharedDistribution) receive(subscriber int, payload []byte, now time.Time) {
+	seq, ok := parseSeqPayload(payload, config.ProbeModuleShared, d.runID)
+	if !ok {
+		return
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	published, ok := d.published[seq]
+	if !ok {
+		return
+	}
+	d.received[subscriber]++
+	if _, ok := d.delivered[seq]; ok {
+		d.duplicated++
+		return
+	}
+	d.delivered[seq] = struct{}{}
+	latency := now.Sub(published)
+	d.latencySum += latency
+	d.latencyMax = max(d.latencyMax, latency)
+	if len(d.delivered) == d.messages {
+		close(d.done)
+	}
+}
+
+// receivedMessages returns the numbers of the messages received by every subscriber.
+func (d *sharedDistribution) receivedMessages() []int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return append([]int(nil), d.received...)
+}
+
+// missing returns the number of the messages which haven't been received by any subscriber.
+func (d *sharedDistribution) missing() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.messages - len(d.delivered)
+}
+
+// duplicatedMessages returns the number of the messages received again, by the same or another subscriber.
+func (d *sharedDistribution) duplicatedMessages() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.duplicated
+}
+
+// latency returns the average and the maximum latency of the delivered messages, they're 0 if none is delivered.
+func (d *sharedDistribution) latency() (avg, maximum time.Duration) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if len(d.delivered) == 0 {
+		return 0, 0
+	}
+	return d.latencySum / time.Duration(len(d.delivered)), d.latencyMax
+}
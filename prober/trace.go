@@ -0,0 +1,417 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"emqx-exporter/config"
+	"emqx-exporter/tlsinfo"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+// The phases of an MQTT probe, in the order they happen.
+const (
+	// phaseResolve is the DNS lookup of the target host.
+	phaseResolve = "resolve"
+	// phaseConnect is the TCP connect, or the whole websocket handshake for `ws` and `wss`.
+	phaseConnect = "connect"
+	// phaseTLS is the TLS handshake of `ssl`, `tls` and `mqtts`.
+	phaseTLS = "tls"
+	// phaseConnack is from sending CONNECT to receiving CONNACK.
+	phaseConnack = "connack"
+	// phaseSubscribe is from sending SUBSCRIBE to receiving SUBACK.
+	phaseSubscribe = "subscribe"
+	// phasePublish is from sending PUBLISH to its completion, i.e. PUBACK for QoS 1 and PUBCOMP for QoS 2.
+	phasePublish = "publish"
+	// phaseRoundtrip is from sending PUBLISH to receiving the message from the subscription.
+	phaseRoundtrip = "roundtrip"
+)
+
+// phaseExpect is the failed phase of the probe expecting a rejection which wasn't rejected, it has no duration.
+const phaseExpect = "expect"
+
+var probePhases = []string{phaseResolve, phaseConnect, phaseTLS, phaseConnack, phaseSubscribe, phasePublish, phaseRoundtrip}
+
+// The acknowledgements whose reason codes are reported by probes, which are the return codes of MQTT 3.
+const (
+	packetConnack = "connack"
+	packetSuback  = "suback"
+	// packetPuback is PUBACK for QoS 1, and PUBREC, or PUBCOMP if PUBREC succeeds, for QoS 2. MQTT 5 only.
+	packetPuback = "puback"
+)
+
+var reasonCodePackets = []string{packetConnack, packetSuback, packetPuback}
+
+// The acknowledgement stages of publishing QoS 1 and 2 messages.
+const (
+	// stagePuback is from sending PUBLISH to receiving PUBACK of QoS 1.
+	stagePuback = "puback"
+	// stagePubrec is from sending PUBLISH to receiving PUBREC of QoS 2.
+	stagePubrec = "pubrec"
+	// stagePubcomp is from sending PUBREL to receiving PUBCOMP of QoS 2.
+	stagePubcomp = "pubcomp"
+)
+
+// ackStages returns the acknowledgement stages of the QoS.
+func ackStages(qos byte) []string {
+	switch qos {
+	case 1:
+		return []string{stagePuback}
+	case 2:
+		return []string{stagePubrec, stagePubcomp}
+	}
+	return nil
+}
+
+// The types of MQTT control packets in the fixed header.
+const (
+	packetTypePublish = 3
+	packetTypePuback  = 4
+	packetTypePubrec  = 5
+	packetTypePubrel  = 6
+	packetTypePubcomp = 7
+)
+
+// probeTrace records the duration of the phases of a probe and the phase which failed.
+type probeTrace struct {
+	mtx       sync.Mutex
+	durations map[string]time.Duration
+	failed    string
+	opened    time.Time
+	// reasonCodes are the reason codes of the acknowledgements of MQTT 5, keyed by the packet type.
+	reasonCodes map[string]byte
+	// sent and received are the times of the first packets sent and received, keyed by the packet type.
+	sent     map[byte]time.Time
+	received map[byte]time.Time
+	// dups is the number of PUBLISH received with the DUP flag, i.e. redelivered by the broker.
+	dups int
+	// shared is the distribution of the messages of the shared module, it's nil for the other modules.
+	shared *sharedDistribution
+	// session is the queue of the messages of the session module, it's nil for the other modules.
+	session *sessionQueue
+	// tls records the TLS handshakes of the connections of the probe.
+	tls *tlsinfo.State
+	// wsStatus is the status code of the last websocket handshake response, 0 if none is received.
+	wsStatus int
+}
+
+func newProbeTrace() *probeTrace {
+	return &probeTrace{
+		durations:   make(map[string]time.Duration, len(probePhases)),
+		reasonCodes: make(map[string]byte, len(reasonCodePackets)),
+		sent:        make(map[byte]time.Time),
+		received:    make(map[byte]time.Time),
+		tls:         tlsinfo.NewState(),
+	}
+}
+
+// observe adds the duration of the phase since start, so the phases of both connections
+// of the cross-node probe are summed.
+func (t *probeTrace) observe(phase string, start time.Time) {
+	d := time.Since(start)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.durations[phase] += d
+}
+
+// fail records the phase as failed, unless a former phase has failed.
+func (t *probeTrace) fail(phase string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.failed == "" {
+		t.failed = phase
+	}
+}
+
+func (t *probeTrace) duration(phase string) time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.durations[phase]
+}
+
+func (t *probeTrace) failedPhase() string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.failed
+}
+
+// observeReasonCode records the reason code, or the return code of MQTT 3, of the packet.
+func (t *probeTrace) observeReasonCode(packet string, code byte) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.reasonCodes[packet] = code
+}
+
+// reasonCode returns the reason code of the packet, and whether the packet has been received.
+func (t *probeTrace) reasonCode(packet string) (byte, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	code, ok := t.reasonCodes[packet]
+	return code, ok
+}
+
+// packetSent records the time of the packet of the fixed header byte sent by the probe.
+func (t *probeTrace) packetSent(header byte) {
+	now := time.Now()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.sent[header>>4]; !ok {
+		t.sent[header>>4] = now
+	}
+}
+
+// packetReceived records the time of the packet of the fixed header byte received by the probe,
+// and counts the PUBLISH with the DUP flag.
+func (t *probeTrace) packetReceived(header byte) {
+	now := time.Now()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if header>>4 == packetTypePublish && header&0x08 != 0 {
+		t.dups++
+	}
+	if _, ok := t.received[header>>4]; !ok {
+		t.received[header>>4] = now
+	}
+}
+
+// ackDuration returns the duration of the acknowledgement stage, 0 if it hasn't completed.
+// The acknowledgements received are always of the messages published by the probe,
+// because only the subscriptions receive PUBREL from the broker.
+func (t *probeTrace) ackDuration(stage string) time.Duration {
+	sentType, receivedType := byte(packetTypePublish), byte(packetTypePuback)
+	switch stage {
+	case stagePubrec:
+		receivedType = packetTypePubrec
+	case stagePubcomp:
+		sentType, receivedType = packetTypePubrel, packetTypePubcomp
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	sent, ok := t.sent[sentType]
+	if !ok {
+		return 0
+	}
+	received, ok := t.received[receivedType]
+	if !ok || received.Before(sent) {
+		return 0
+	}
+	return received.Sub(sent)
+}
+
+// dupsReceived returns the number of PUBLISH received with the DUP flag.
+func (t *probeTrace) dupsReceived() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.dups
+}
+
+// connectionOpened returns when the network connection was opened, it's the start of CONNECT.
+func (t *probeTrace) connectionOpened() time.Time {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.opened
+}
+
+// openConnection returns the function opening the network connection of the probe like the default of the
+// MQTT client, recording the durations of the resolve, connect and tls phases.
+func (t *probeTrace) openConnection(ctx context.Context, probe config.Probe) mqtt.OpenConnectionFunc {
+	ws := newWebsocketOptions(probe)
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		conn, err := t.dial(ctx, uri, options.TLSConfig, ws, options.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		t.mtx.Lock()
+		t.opened = time.Now()
+		t.mtx.Unlock()
+		return conn, nil
+	}
+}
+
+// dial opens the network connection to the broker of the uri, recording the durations of the resolve,
+// connect and tls phases, and the times of the packets on the connection. The zero timeout means no timeout.
+// The connection is closed once ctx is done, so that the clients waiting on it give up.
+func (t *probeTrace) dial(ctx context.Context, uri *url.URL, tlsConfig *tls.Config, ws websocketOptions, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.dialURI(ctx, uri, tlsConfig, ws, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{
+		Conn:    conn,
+		stop:    context.AfterFunc(ctx, func() { _ = conn.Close() }),
+		read:    packetScanner{onPacket: t.packetReceived},
+		written: packetScanner{onPacket: t.packetSent},
+	}, nil
+}
+
+func (t *probeTrace) dialURI(ctx context.Context, uri *url.URL, tlsConfig *tls.Config, ws websocketOptions, timeout time.Duration) (net.Conn, error) {
+	switch uri.Scheme {
+	case "ws", "wss":
+		// The websocket dialer resolves the host and shakes hands by itself.
+		if uri.Scheme == "ws" {
+			tlsConfig = nil
+		} else {
+			tlsConfig = t.tls.Config(tlsConfig, uri.Hostname())
+		}
+		start := time.Now()
+		conn, err := t.dialWebsocket(ctx, uri, tlsConfig, ws, timeout)
+		t.observe(phaseConnect, start)
+		if err != nil {
+			t.fail(phaseConnect)
+		}
+		return conn, err
+	case "mqtt", "tcp":
+		return t.dialTCP(ctx, uri.Host, timeout)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		conn, err := t.dialTCP(ctx, uri.Host, timeout)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := timeoutContext(ctx, timeout)
+		defer cancel()
+		start := time.Now()
+		tlsConn := tls.Client(conn, t.tls.Config(tlsConfig, uri.Hostname()))
+		err = tlsConn.HandshakeContext(ctx)
+		t.observe(phaseTLS, start)
+		if err != nil {
+			t.fail(phaseTLS)
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return nil, errors.New("unknown protocol")
+}
+
+// dialTCP resolves the host and connects to its addresses in turn. The proxy of `all_proxy`
+// is used if it's set, then the host is resolved by the proxy and the resolve phase is skipped.
+func (t *probeTrace) dialTCP(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	if os.Getenv("all_proxy") != "" {
+		start := time.Now()
+		conn, err := proxy.Dial(ctx, "tcp", address)
+		t.observe(phaseConnect, start)
+		if err != nil {
+			t.fail(phaseConnect)
+		}
+		return conn, err
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.fail(phaseResolve)
+		return nil, err
+	}
+	var dialer net.Dialer
+	ctx, cancel := timeoutContext(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	t.observe(phaseResolve, start)
+	if err != nil {
+		t.fail(phaseResolve)
+		return nil, err
+	}
+
+	start = time.Now()
+	defer t.observe(phaseConnect, start)
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	t.fail(phaseConnect)
+	return nil, err
+}
+
+// tracedConn scans the MQTT packets read and written on the connection.
+type tracedConn struct {
+	net.Conn
+	// stop stops closing the connection once the context of the probe is done.
+	stop func() bool
+	read packetScanner
+
+	mtx     sync.Mutex
+	written packetScanner
+}
+
+func (c *tracedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.scan(b[:n])
+	return n, err
+}
+
+func (c *tracedConn) Write(b []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	n, err := c.Conn.Write(b)
+	c.written.scan(b[:n])
+	return n, err
+}
+
+func (c *tracedConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// The states of packetScanner.
+const (
+	scanHeader = iota
+	scanLength
+	scanBody
+)
+
+// packetScanner follows the MQTT packets in a stream, and calls onPacket with the first byte of
+// the fixed header of each packet as soon as it's scanned.
+type packetScanner struct {
+	onPacket   func(header byte)
+	state      int
+	remaining  int
+	multiplier int
+}
+
+func (s *packetScanner) scan(b []byte) {
+	for len(b) > 0 {
+		switch s.state {
+		case scanHeader:
+			s.onPacket(b[0])
+			s.state, s.remaining, s.multiplier = scanLength, 0, 1
+			b = b[1:]
+		case scanLength:
+			// The remaining length is a variable byte integer, the high bit means more bytes follow.
+			s.remaining += int(b[0]&0x7f) * s.multiplier
+			s.multiplier *= 128
+			if b[0]&0x80 == 0 {
+				s.state = scanBody
+				if s.remaining == 0 {
+					s.state = scanHeader
+				}
+			}
+			b = b[1:]
+		case scanBody:
+			n := min(len(b), s.remaining)
+			s.remaining -= n
+			if s.remaining == 0 {
+				s.state = scanHeader
+			}
+			b = b[n:]
+		}
+	}
+}
+
+// timeoutContext returns the context of ctx with the timeout, the zero timeout means no timeout.
+func timeoutContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
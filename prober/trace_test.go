@@ -0,0 +1,46 @@
+package prober
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestProbeTracePackets(t *testing.T) {
+	trace := newProbeTrace()
+	written := packetScanner{onPacket: trace.packetSent}
+	read := packetScanner{onPacket: trace.packetReceived}
+
+	// feed scans the stream in chunks of 3 bytes, so that the packets are split at any position.
+	feed := func(s *packetScanner, stream []byte) {
+		for len(stream) > 0 {
+			n := min(3, len(stream))
+			s.scan(stream[:n])
+			stream = stream[n:]
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// PUBLISH of QoS 2 whose remaining length of 200 takes 2 bytes.
+	feed(&written, append([]byte{0x34, 0xc8, 0x01}, bytes.Repeat([]byte{'x'}, 200)...))
+	// PUBREC, and the message redelivered with DUP by the broker.
+	feed(&read, append([]byte{0x50, 0x02, 0x00, 0x01, 0x3c, 0x05}, bytes.Repeat([]byte{'y'}, 5)...))
+	// PUBREL and PUBCOMP, and PINGREQ without the variable header.
+	feed(&written, []byte{0x62, 0x02, 0x00, 0x01, 0xc0, 0x00})
+	feed(&read, []byte{0x70, 0x02, 0x00, 0x01})
+
+	if d := trace.ackDuration(stagePuback); d != 0 {
+		t.Errorf("Expected no duration of the stage puback but got %s", d)
+	}
+	for _, stage := range []string{stagePubrec, stagePubcomp} {
+		if d := trace.ackDuration(stage); d <= 0 {
+			t.Errorf("Expected the duration of the stage %s but got %s", stage, d)
+		}
+	}
+	if dups := trace.dupsReceived(); dups != 1 {
+		t.Errorf("Expected 1 DUP received but got %d", dups)
+	}
+	if _, ok := trace.sent[0xc]; !ok {
+		t.Errorf("Expected PINGREQ to be scanned after PUBREL")
+	}
+}
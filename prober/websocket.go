@@ -0,0 +1,134 @@
+package prober
+
+import (
+	"emqx-exporter/config"
+
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketOptions are the options of the websocket handshake of `ws` and `wss`.
+type websocketOptions struct {
+	// path is the path of the endpoint, unless the target has one.
+	path        string
+	subprotocol string
+	headers     http.Header
+	// proxy is the proxy of the handshake, the proxy of the environment is used if it's nil.
+	proxy *url.URL
+}
+
+func newWebsocketOptions(probe config.Probe) websocketOptions {
+	ws := websocketOptions{
+		path:        probe.WSPath,
+		subprotocol: probe.WSSubprotocol,
+		headers:     make(http.Header, len(probe.WSHeaders)),
+	}
+	for name, value := range probe.WSHeaders {
+		ws.headers.Set(name, string(value))
+	}
+	if probe.ProxyURL != "" {
+		// The proxy URL has been validated by the config.
+		ws.proxy, _ = url.Parse(string(probe.ProxyURL))
+	}
+	return ws
+}
+
+// dialWebsocket shakes hands with the websocket endpoint of the uri, recording the status code of the
+// handshake response. The zero timeout means no timeout.
+func (t *probeTrace) dialWebsocket(ctx context.Context, uri *url.URL, tlsConfig *tls.Config, ws websocketOptions, timeout time.Duration) (net.Conn, error) {
+	wsURL := *uri
+	wsURL.User = nil
+	if wsURL.Path == "" {
+		wsURL.Path = ws.path
+	}
+	proxy := http.ProxyFromEnvironment
+	if ws.proxy != nil {
+		proxy = http.ProxyURL(ws.proxy)
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            proxy,
+		HandshakeTimeout: timeout,
+		TLSClientConfig:  tlsConfig,
+	}
+	if ws.subprotocol != "" {
+		dialer.Subprotocols = []string{ws.subprotocol}
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, wsURL.String(), ws.headers)
+	if resp != nil {
+		t.mtx.Lock()
+		t.wsStatus = resp.StatusCode
+		t.mtx.Unlock()
+	}
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket handshake failed with status %d: %w", resp.StatusCode, err)
+		}
+		return nil, err
+	}
+	return &websocketConn{Conn: conn}, nil
+}
+
+// handshakeStatus returns the status code of the last websocket handshake response, ok is false if none is received.
+func (t *probeTrace) handshakeStatus() (code int, ok bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.wsStatus, t.wsStatus != 0
+}
+
+// websocketConn is the network connection over the binary messages of a websocket. The writes are serialized,
+// as the websocket supports one concurrent writer only.
+type websocketConn struct {
+	*websocket.Conn
+	r   io.Reader
+	rio sync.Mutex
+	wio sync.Mutex
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	c.rio.Lock()
+	defer c.rio.Unlock()
+	for {
+		if c.r == nil {
+			var err error
+			if _, c.r, err = c.NextReader(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			// The message has been read, the next one is read if nothing is read from this one.
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,195 @@
+// Package tlsinfo records the TLS handshakes of the connections to EMQX, and exposes the certificates
+// presented by the servers, the negotiated versions and cipher suites, and the results of verifying
+// the certificate chains as metrics.
+package tlsinfo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "emqx"
+	subsystem = "tls"
+)
+
+// handshake is the last handshake with a server.
+type handshake struct {
+	serverName string
+	state      tls.ConnectionState
+	verifyErr  error
+}
+
+// State records the last handshake with every server, keyed by the server name.
+type State struct {
+	mtx        sync.Mutex
+	handshakes map[string]handshake
+}
+
+func NewState() *State {
+	return &State{handshakes: make(map[string]handshake)}
+}
+
+// Config returns a copy of the config which records the handshakes of its connections to the server, whose name
+// is used unless the config has one. The certificate chain is verified by VerifyConnection instead of the handshake
+// itself, so that the chain is recorded even if it fails the verification. The connections are refused as before,
+// and the chain is still verified against the root CAs of the config if the verification is skipped by
+// InsecureSkipVerify, only for the metrics.
+func (s *State) Config(cfg *tls.Config, serverName string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+	// The server name of the connection state is empty for an IP address, as it's not sent by SNI,
+	// and the config may be cloned by the dialer, so the server name is taken from this config.
+	serverName = cfg.ServerName
+	insecure, verify := cfg.InsecureSkipVerify, cfg.VerifyConnection
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		var err error
+		// The config which skips the verification but has VerifyConnection verifies the chain by itself.
+		if !insecure || verify == nil {
+			err = verifyChain(cfg, serverName, cs)
+		}
+		if err == nil && verify != nil {
+			err = verify(cs)
+		}
+		s.record(serverName, cs, err)
+		if insecure && verify == nil {
+			return nil
+		}
+		return err
+	}
+	return cfg
+}
+
+// verifyChain verifies the certificate chain of the connection like the handshake does.
+func verifyChain(cfg *tls.Config, serverName string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server didn't provide a certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         cfg.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	if cfg.Time != nil {
+		opts.CurrentTime = cfg.Time()
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func (s *State) record(serverName string, cs tls.ConnectionState, verifyErr error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.handshakes[serverName] = handshake{serverName: serverName, state: cs, verifyErr: verifyErr}
+}
+
+// snapshot returns the last handshakes sorted by the server name.
+func (s *State) snapshot() []handshake {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	handshakes := make([]handshake, 0, len(s.handshakes))
+	for _, h := range s.handshakes {
+		handshakes = append(handshakes, h)
+	}
+	sort.Slice(handshakes, func(i, j int) bool {
+		return handshakes[i].serverName < handshakes[j].serverName
+	})
+	return handshakes
+}
+
+// Collector exposes the last handshakes of a State as metrics, it exposes nothing if there has been none.
+type Collector struct {
+	state    *State
+	notAfter *prometheus.Desc
+	certInfo *prometheus.Desc
+	version  *prometheus.Desc
+	cipher   *prometheus.Desc
+	verified *prometheus.Desc
+}
+
+func NewCollector(state *State, constLabels prometheus.Labels) *Collector {
+	newDesc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, name),
+			help,
+			append([]string{"server_name"}, labels...),
+			constLabels,
+		)
+	}
+	return &Collector{
+		state:    state,
+		notAfter: newDesc("cert_not_after_seconds", "The expiration time of every certificate presented by the server in unixtime", "subject", "issuer", "serial_number"),
+		certInfo: newDesc("cert_info", "The subject, issuer and subject alternative names of the certificate of the server", "subject", "issuer", "san"),
+		version:  newDesc("version_info", "The TLS version negotiated with the server", "version"),
+		cipher:   newDesc("cipher_info", "The cipher suite negotiated with the server", "cipher"),
+		verified: newDesc("chain_verified", "Displays whether or not the certificate chain of the server was verified"),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.notAfter
+	ch <- c.certInfo
+	ch <- c.version
+	ch <- c.cipher
+	ch <- c.verified
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, h := range c.state.snapshot() {
+		cs, serverName := h.state, h.serverName
+		// The same certificate may be presented more than once in the chain.
+		seen := make(map[string]struct{}, len(cs.PeerCertificates))
+		for _, cert := range cs.PeerCertificates {
+			subject, issuer, serial := cert.Subject.String(), cert.Issuer.String(), cert.SerialNumber.Text(16)
+			key := subject + "\x00" + issuer + "\x00" + serial
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			ch <- prometheus.MustNewConstMetric(c.notAfter, prometheus.GaugeValue,
+				float64(cert.NotAfter.Unix()), serverName, subject, issuer, serial)
+		}
+		if len(cs.PeerCertificates) > 0 {
+			leaf := cs.PeerCertificates[0]
+			ch <- prometheus.MustNewConstMetric(c.certInfo, prometheus.GaugeValue, 1,
+				serverName, leaf.Subject.String(), leaf.Issuer.String(), subjectAltNames(leaf))
+		}
+		ch <- prometheus.MustNewConstMetric(c.version, prometheus.GaugeValue, 1, serverName, tls.VersionName(cs.Version))
+		ch <- prometheus.MustNewConstMetric(c.cipher, prometheus.GaugeValue, 1, serverName, tls.CipherSuiteName(cs.CipherSuite))
+		verified := 0.0
+		if h.verifyErr == nil {
+			verified = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.verified, prometheus.GaugeValue, verified, serverName)
+	}
+}
+
+// subjectAltNames returns the DNS names, IP addresses, email addresses and URIs of the certificate, separated by commas.
+func subjectAltNames(cert *x509.Certificate) string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,99 @@
+package tlsinfo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStateConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	refused := errors.New("refused by VerifyConnection")
+
+	testcases := []struct {
+		name   string
+		config *tls.Config
+		// serverName is passed to Config, it's the name verified unless the config has one.
+		serverName string
+		refused    bool
+		verified   bool
+	}{
+		{
+			name:       "verified",
+			config:     &tls.Config{RootCAs: roots},
+			serverName: "127.0.0.1",
+			verified:   true,
+		},
+		{
+			name:       "server name of the config",
+			config:     &tls.Config{RootCAs: roots, ServerName: "example.com"},
+			serverName: "127.0.0.1",
+			verified:   true,
+		},
+		{
+			name:       "server name mismatch",
+			config:     &tls.Config{RootCAs: roots},
+			serverName: "localhost",
+			refused:    true,
+		},
+		{
+			name:       "unknown ca",
+			config:     &tls.Config{RootCAs: x509.NewCertPool()},
+			serverName: "127.0.0.1",
+			refused:    true,
+		},
+		{
+			name:       "insecure skip verify",
+			config:     &tls.Config{RootCAs: x509.NewCertPool(), InsecureSkipVerify: true},
+			serverName: "127.0.0.1",
+		},
+		{
+			name: "refused by VerifyConnection",
+			config: &tls.Config{RootCAs: roots, VerifyConnection: func(tls.ConnectionState) error {
+				return refused
+			}},
+			serverName: "127.0.0.1",
+			refused:    true,
+		},
+		{
+			// The config which verifies the chain by itself, like the config of the TLS files.
+			name: "verified by VerifyConnection",
+			config: &tls.Config{InsecureSkipVerify: true, VerifyConnection: func(tls.ConnectionState) error {
+				return nil
+			}},
+			serverName: "127.0.0.1",
+			verified:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := NewState()
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), state.Config(tc.config, tc.serverName))
+			if err == nil {
+				conn.Close()
+			}
+			if (err != nil) != tc.refused {
+				t.Errorf("Expected the connection to be refused %v but got %v", tc.refused, err)
+			}
+
+			handshakes := state.snapshot()
+			if len(handshakes) != 1 {
+				t.Fatalf("Expected 1 handshake recorded but got %d", len(handshakes))
+			}
+			expectedName := tc.serverName
+			if tc.config.ServerName != "" {
+				expectedName = tc.config.ServerName
+			}
+			if h := handshakes[0]; h.serverName != expectedName || (h.verifyErr == nil) != tc.verified {
+				t.Errorf("Expected the handshake with %s verified %v but got %s verified by %v", expectedName, tc.verified, h.serverName, h.verifyErr)
+			}
+		})
+	}
+}